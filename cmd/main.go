@@ -17,31 +17,32 @@ limitations under the License.
 package main
 
 import (
-	"context"
 	"crypto/tls"
 	"flag"
-	"github.com/go-logr/logr"
-	corev1 "k8s.io/api/core/v1"
 	"os"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/hebestreit/pod-image-aging/internal/breaker"
 	"github.com/hebestreit/pod-image-aging/internal/cache"
 	"github.com/hebestreit/pod-image-aging/internal/controller"
+	"github.com/hebestreit/pod-image-aging/internal/imagefilter"
+	"github.com/hebestreit/pod-image-aging/internal/telemetry"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -65,6 +66,24 @@ func main() {
 	var tlsOpts []func(*tls.Config)
 	var controllerOpts = &controller.Opts{}
 	var metricsInterval time.Duration
+	var metricsAllReplicas bool
+	var registryProxies string
+	var breakerThreshold int
+	var breakerCoolDown time.Duration
+	var imageAgeBuckets string
+	var imageAgePercentiles string
+	var aggregatedContainerTypes string
+	var metricsRegistries string
+	var metricsNamespaceLabels string
+	var metricsPodLabels string
+	var ageThresholds string
+	var includeImages string
+	var excludeImages string
+	var namespaceSelector string
+	var podSelector string
+	var otlpMetricsInterval time.Duration
+	var otlpTraces bool
+	telemetryOpts := &telemetry.Opts{}
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false, "Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
@@ -73,11 +92,38 @@ func main() {
 
 	flag.StringVar(&controllerOpts.IncludeNamespacesFilter, "include-namespaces", "", "Comma-separated list of namespaces to include")
 	flag.StringVar(&controllerOpts.ExcludeNamespacesFilter, "exclude-namespaces", "", "Comma-separated list of namespaces to exclude")
-	flag.StringVar(&controllerOpts.IncludeImagesFilter, "include-images", "", "Regular expression to include images")
-	flag.StringVar(&controllerOpts.ExcludeImagesFilter, "exclude-images", "", "Regular expression to exclude images")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "", "Label selector of the namespaces to include, e.g. team in (a,b),!legacy")
+	flag.StringVar(&podSelector, "pod-selector", "", "Label selector of the pods to include, e.g. app.kubernetes.io/managed-by=Helm")
+	flag.StringVar(&includeImages, "include-images", "", "Comma-separated list of image patterns to include, e.g. ghcr.io/hebestreit/**")
+	flag.StringVar(&excludeImages, "exclude-images", "", "Comma-separated list of image patterns to exclude, e.g. registry=*.dkr.ecr.*.amazonaws.com")
 	flag.DurationVar(&controllerOpts.CacheExpiration, "cache-expiration", 168*time.Hour, "Expiration time for the cache")
 	flag.StringVar(&controllerOpts.DockerAuthConfigPath, "docker-auth-config-path", "", "Path to the Docker auth config")
-	flag.DurationVar(&metricsInterval, "metrics-interval", 30*time.Minute, "Interval to update the metrics")
+	flag.IntVar(&controllerOpts.HistoryLimit, "history-limit", 0, "Number of image digests kept in the rollout history annotation of a workload, 0 disables the history which requires to patch the workloads")
+	flag.DurationVar(&controllerOpts.RegistryConnectTimeout, "registry-connect-timeout", 15*time.Second, "Timeout to connect to a registry, authenticate and fetch the image manifest")
+	flag.DurationVar(&controllerOpts.RegistryReadTimeout, "registry-read-timeout", 30*time.Second, "Timeout to read the image configuration of a single platform")
+	flag.DurationVar(&controllerOpts.InspectionTimeout, "inspection-timeout", 2*time.Minute, "Overall timeout to inspect an image including all platforms of an image index")
+	flag.IntVar(&controllerOpts.MaxIndexPlatforms, "max-index-platforms", 4, "Number of other platforms of an image index which are inspected to get the creation date of the index, 0 only inspects the platform of the node")
+	flag.StringVar(&registryProxies, "registry-proxies", "", "Comma-separated list of registry=proxy pairs to override HTTP_PROXY and HTTPS_PROXY, use \"direct\" as proxy to bypass it")
+	flag.IntVar(&breakerThreshold, "registry-breaker-threshold", 5, "Number of consecutive failures after which inspections of a registry are paused, use 0 to disable")
+	flag.DurationVar(&breakerCoolDown, "registry-breaker-cool-down", 5*time.Minute, "Duration to pause inspections of a registry before probing it again")
+	flag.StringVar(&telemetryOpts.Endpoint, "otlp-endpoint", "", "Host and port of the OTLP receiver, e.g. otel-collector:4317, enables the OTLP export if set")
+	flag.StringVar(&telemetryOpts.Protocol, "otlp-protocol", telemetry.ProtocolGRPC, "Protocol of the OTLP receiver, either grpc or http")
+	flag.BoolVar(&telemetryOpts.Insecure, "otlp-insecure", false, "If set, TLS is disabled for the OTLP export")
+	flag.StringVar(&telemetryOpts.ClusterName, "cluster-name", "", "Name of the cluster which is added as k8s.cluster.name resource attribute to the OTLP export")
+	flag.DurationVar(&otlpMetricsInterval, "otlp-metrics-interval", time.Minute, "Interval to export the metrics via OTLP")
+	flag.BoolVar(&otlpTraces, "otlp-traces", false, "If set, spans of reconciles and image inspections are exported via OTLP")
+	flag.DurationVar(&metricsInterval, "metrics-interval", 30*time.Minute, "Interval of the consistency sweep which updates the metrics of all namespaces")
+	flag.BoolVar(&metricsAllReplicas, "metrics-all-replicas", false, "If set, the image age metrics are exported by all replicas instead of the leader only")
+	flag.StringVar(&aggregatedContainerTypes, "metrics-container-types", "container", "Comma-separated list of container types (container, init, ephemeral) which count toward the namespace and workload metrics")
+	flag.StringVar(&metricsRegistries, "metrics-registries", "", "Comma-separated list of registry globs whose repositories are exported in the repository metrics")
+	flag.StringVar(&metricsNamespaceLabels, "metrics-namespace-labels", "", "Comma-separated list of namespace label keys which are copied into the metric labels")
+	flag.StringVar(&metricsPodLabels, "metrics-pod-labels", "", "Comma-separated list of pod label keys which are copied into the metric labels of containers")
+	flag.IntVar(&controllerOpts.MaxSeriesPerFamily, "metrics-max-series-per-family", 0, "Maximum number of series of each workload, container and repository metric, 0 disables the limit")
+	flag.IntVar(&controllerOpts.MaxSeriesPerNamespace, "metrics-max-series-per-namespace", 0, "Maximum number of series of each workload and container metric per namespace, 0 disables the limit")
+	flag.StringVar(&ageThresholds, "metrics-age-thresholds", "", "Comma-separated list of name=days pairs of image age thresholds, e.g. policy=180")
+	flag.DurationVar(&controllerOpts.MaxImageAge, "max-image-age", 0, "Maximum image age of the policy, exports the time until each workload exceeds it if set")
+	flag.StringVar(&imageAgePercentiles, "metrics-image-age-percentiles", "50,90,99", "Comma-separated list of image age percentiles to export per namespace")
+	flag.StringVar(&imageAgeBuckets, "metrics-image-age-buckets", "7,30,90,180,365", "Comma-separated list of image age bucket upper bounds in days")
 
 	opts := zap.Options{
 		Development: true,
@@ -87,6 +133,71 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	var err error
+	if controllerOpts.RegistryProxies, err = controller.ParseRegistryProxies(registryProxies); err != nil {
+		setupLog.Error(err, "unable to parse registry proxies")
+		os.Exit(1)
+	}
+	if err = controllerOpts.RegistryProxies.RouteDirect(); err != nil {
+		setupLog.Error(err, "unable to route registries directly")
+		os.Exit(1)
+	}
+	if controllerOpts.ImageAgeBuckets, err = controller.ParseImageAgeBuckets(imageAgeBuckets); err != nil {
+		setupLog.Error(err, "unable to parse image age buckets")
+		os.Exit(1)
+	}
+	if controllerOpts.ImageAgePercentiles, err = controller.ParseImageAgePercentiles(imageAgePercentiles); err != nil {
+		setupLog.Error(err, "unable to parse image age percentiles")
+		os.Exit(1)
+	}
+	if controllerOpts.IncludeImages, err = imagefilter.Parse(includeImages); err != nil {
+		setupLog.Error(err, "unable to parse included images")
+		os.Exit(1)
+	}
+	if controllerOpts.ExcludeImages, err = imagefilter.Parse(excludeImages); err != nil {
+		setupLog.Error(err, "unable to parse excluded images")
+		os.Exit(1)
+	}
+	for _, glob := range append(imagefilter.SingleStarGlobs(includeImages), imagefilter.SingleStarGlobs(excludeImages)...) {
+		setupLog.Info("* in image patterns doesn't match / anymore, use ** to match across path segments as before", "pattern", glob)
+	}
+	if controllerOpts.MetricsRegistries, err = imagefilter.ParseRegistries(metricsRegistries); err != nil {
+		setupLog.Error(err, "unable to parse metrics registries")
+		os.Exit(1)
+	}
+	if controllerOpts.MetricsNamespaceLabels, err = controller.ParseLabelKeys(metricsNamespaceLabels); err != nil {
+		setupLog.Error(err, "unable to parse metrics namespace labels")
+		os.Exit(1)
+	}
+	if controllerOpts.MetricsPodLabels, err = controller.ParseLabelKeys(metricsPodLabels); err != nil {
+		setupLog.Error(err, "unable to parse metrics pod labels")
+		os.Exit(1)
+	}
+	if err = telemetryOpts.Validate(); err != nil {
+		setupLog.Error(err, "unable to configure OTLP export")
+		os.Exit(1)
+	}
+	if controllerOpts.AgeThresholds, err = controller.ParseAgeThresholds(ageThresholds); err != nil {
+		setupLog.Error(err, "unable to parse age thresholds")
+		os.Exit(1)
+	}
+	if controllerOpts.AggregatedContainerTypes, err = controller.ParseContainerTypes(aggregatedContainerTypes); err != nil {
+		setupLog.Error(err, "unable to parse container types")
+		os.Exit(1)
+	}
+	if namespaceSelector != "" {
+		if controllerOpts.NamespaceSelector, err = labels.Parse(namespaceSelector); err != nil {
+			setupLog.Error(err, "unable to parse namespace selector")
+			os.Exit(1)
+		}
+	}
+	if podSelector != "" {
+		if controllerOpts.PodSelector, err = labels.Parse(podSelector); err != nil {
+			setupLog.Error(err, "unable to parse pod selector")
+			os.Exit(1)
+		}
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -134,6 +245,7 @@ func main() {
 		Scheme:                 scheme,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
+		Cache:                  controller.NewCacheOptions(controllerOpts),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "54896c62.pod-image-aging.hbst.io",
@@ -154,13 +266,37 @@ func main() {
 		os.Exit(1)
 	}
 
-	memoryCache := cache.NewCache()
+	memoryCache := cache.NewCache[controller.ImageInfo]()
+
+	var registryBreaker *breaker.Breaker
+	if breakerThreshold > 0 {
+		registryBreaker = controller.NewRegistryBreaker(breakerThreshold, breakerCoolDown)
+	}
+
+	// the metrics are exported via the metrics endpoint, OTLP or both
+	var metricsUpdater *controller.MetricsUpdater
+	if metricsAddr != "0" || telemetryOpts.Endpoint != "" {
+		metricsRecorder, err := controller.NewMetricsRecorder(mgr.GetClient(), controllerOpts)
+		if err != nil {
+			setupLog.Error(err, "unable to create metrics recorder")
+			os.Exit(1)
+		}
+		metricsUpdater = controller.NewMetricsUpdater(metricsRecorder, mgr.GetCache(), metricsInterval, metricsAllReplicas)
+	}
+
+	reconcilerMetrics := metricsUpdater
+	if metricsAllReplicas {
+		// the metrics updater of each replica queues the namespaces from the pod events
+		reconcilerMetrics = nil
+	}
 
 	if err = (&controller.PodReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Cache:  memoryCache,
-		Opts:   controllerOpts,
+		Client:  mgr.GetClient(),
+		Scheme:  mgr.GetScheme(),
+		Cache:   memoryCache,
+		Breaker: registryBreaker,
+		Metrics: reconcilerMetrics,
+		Opts:    controllerOpts,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Pod")
 		os.Exit(1)
@@ -175,51 +311,42 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
-
-	if metricsAddr != "0" {
-		// TODO use Runnable instead of goroutine to make sure it's gracefully stopped when the manager stops
-		metricsClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{})
-		if err != nil {
-			setupLog.Error(err, "unable to create client for metrics")
+	if registryBreaker != nil {
+		if err := mgr.AddReadyzCheck("registries", registryBreaker.Check); err != nil {
+			setupLog.Error(err, "unable to set up registries ready check")
 			os.Exit(1)
 		}
-		go startMetricsUpdater(metricsClient, ctrl.Log.WithName("metrics"), metricsInterval)
 	}
 
-	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+	if metricsUpdater != nil {
+		if err := mgr.Add(metricsUpdater); err != nil {
+			setupLog.Error(err, "unable to set up metrics updater")
+			os.Exit(1)
+		}
 	}
-}
 
-// startMetricsUpdater runs a periodic job to update the custom metrics
-func startMetricsUpdater(c client.Client, log logr.Logger, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		// Call the updateMetrics function periodically
-		log.Info("Updating metrics...")
-		namespaces := &corev1.NamespaceList{}
-		err := c.List(context.Background(), namespaces)
-		if err != nil {
-			log.Error(err, "failed to list namespaces")
-			continue
+	if telemetryOpts.Endpoint != "" {
+		if err := mgr.Add(&telemetry.MetricsExporter{
+			Opts:     telemetryOpts,
+			Gatherer: ctrlmetrics.Registry,
+			Prefix:   "pod_image_aging_",
+			Interval: otlpMetricsInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up OTLP metrics exporter")
+			os.Exit(1)
 		}
+	}
 
-		for _, namespace := range namespaces.Items {
-			if err := controller.UpdateMetrics(c, namespace.Name, log); err != nil {
-				log.Error(err, "failed to update metrics for namespace", "namespace", namespace.Name)
-			}
+	if telemetryOpts.Endpoint != "" && otlpTraces {
+		if err := mgr.Add(&telemetry.TraceExporter{Opts: telemetryOpts}); err != nil {
+			setupLog.Error(err, "unable to set up OTLP trace exporter")
+			os.Exit(1)
 		}
+	}
 
-		select {
-		case <-ticker.C:
-			continue
-		case <-context.Background().Done():
-			log.Info("Metrics updater stopped")
-			return
-		}
+	setupLog.Info("starting manager")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running manager")
+		os.Exit(1)
 	}
 }
@@ -8,6 +8,8 @@ export LC_NUMERIC="en_US.UTF-8"
 # Initialize associative arrays and counters for total and per-namespace sums
 declare -A namespace_sum
 declare -A namespace_count
+declare -A workload_sum
+declare -A workload_count
 total_sum=0
 total_count=0
 
@@ -15,7 +17,7 @@ date
 echo ""
 
 TABLE_PODS=""
-while IFS=$'\t' read -r namespace name container image last_updated; do
+while IFS=$'\t' read -r namespace name workload container image last_updated; do
     # Parse the last_updated date and calculate the current time
     last_updated_epoch=$(date -j -f "%Y-%m-%dT%H:%M:%S" ${last_updated%Z*} +%s 2>/dev/null || echo 0)
     current_epoch=$(date +%s)
@@ -25,7 +27,7 @@ while IFS=$'\t' read -r namespace name container image last_updated; do
     weeks=$((age / 604800))  # 1 week = 604800 seconds
 
     # Store each row in a temporary format including epoch time for sorting
-    TABLE_PODS+="$namespace\t$name\t$container\t$image\t$weeks weeks\n"
+    TABLE_PODS+="$namespace\t$name\t$workload\t$container\t$image\t$weeks weeks\n"
 
     # Track the total sum of weeks for averages
     total_sum=$((total_sum + weeks))
@@ -34,17 +36,22 @@ while IFS=$'\t' read -r namespace name container image last_updated; do
     # Track namespace-specific sums and counts for averages
     namespace_sum["$namespace"]=$((namespace_sum["$namespace"] + weeks))
     namespace_count["$namespace"]=$((namespace_count["$namespace"] + 1))
+
+    # Track workload-specific sums and counts for averages
+    workload_sum["$namespace\t$workload"]=$((workload_sum["$namespace\t$workload"] + weeks))
+    workload_count["$namespace\t$workload"]=$((workload_count["$namespace\t$workload"] + 1))
 done < <(
   echo $INPUT_JSON | jq -r '
   .items[] |
   .metadata as $meta |
   .spec.containers[] as $container |
   ($meta.annotations["pod-image-aging.hbst.io/status"] ) |
-  try (fromjson.containers[] | select(.name == $container.name))?
-  | "\($meta.namespace)\t\($meta.name)\t\($container.name)\t\($container.image)\t\(.createdAt // "N/A")"
+  try (fromjson as $status | $status.containers[] | select(.name == $container.name)
+    | .owner = ($status.owner // {kind: "Pod", name: $meta.name}))?
+  | "\($meta.namespace)\t\($meta.name)\t\(.owner.kind)/\(.owner.name)\t\($container.name)\t\($container.image)\t\(.createdAt // "N/A")"
 ')
 
-echo -e "NAMESPACE\tNAME\tCONTAINER\tIMAGE\tIMAGE AGE\n$(echo -e "$TABLE_PODS" | sort -k5 -rn)" | column -t -s$'\t'
+echo -e "NAMESPACE\tNAME\tWORKLOAD\tCONTAINER\tIMAGE\tIMAGE AGE\n$(echo -e "$TABLE_PODS" | sort -t$'\t' -k6 -rn)" | column -t -s$'\t'
 
 # Print averages grouped by namespace
 TABLE_NAMESPACES=""
@@ -56,6 +63,16 @@ done
 echo ""
 echo -e "NAMESPACE\tIMAGE AGE (avg)\n$(echo -e "$TABLE_NAMESPACES" | sort -k2 -rn )"| column -t -s$'\t'
 
+# Print averages grouped by workload
+TABLE_WORKLOADS=""
+for wl in "${!workload_sum[@]}"; do
+  wl_avg=$(echo "${workload_sum[$wl]} / ${workload_count[$wl]}" | bc -l)
+  TABLE_WORKLOADS+="$(printf "%s\t%.0f\n" "$wl" "$wl_avg") weeks\n"
+done
+
+echo ""
+echo -e "NAMESPACE\tWORKLOAD\tIMAGE AGE (avg)\n$(echo -e "$TABLE_WORKLOADS" | sort -t$'\t' -k3 -rn )"| column -t -s$'\t'
+
 echo ""
 # Print total average across all namespaces
 if [ $total_count -gt 0 ]; then
@@ -0,0 +1,169 @@
+package breaker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// OpenError is returned if a call is short-circuited because the circuit of the key is open
+type OpenError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open, retry after %s", e.Key, e.RetryAfter)
+}
+
+type circuit struct {
+	state    State
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+}
+
+// Breaker maintains a circuit per key which opens after consecutive failures. Once the cool-down has passed, a single
+// probe is allowed in the half-open state which either closes the circuit again or keeps it open.
+type Breaker struct {
+	threshold     int
+	coolDown      time.Duration
+	onStateChange func(key string, state State)
+	circuits      map[string]*circuit
+	mutex         sync.Mutex
+	// now returns the current time and is replaced in tests
+	now func() time.Time
+}
+
+// NewBreaker Create a new breaker which opens after threshold consecutive failures. onStateChange may be nil.
+func NewBreaker(threshold int, coolDown time.Duration, onStateChange func(key string, state State)) *Breaker {
+	return &Breaker{
+		threshold:     threshold,
+		coolDown:      coolDown,
+		onStateChange: onStateChange,
+		circuits:      make(map[string]*circuit),
+		now:           time.Now,
+	}
+}
+
+// Allow returns an OpenError if calls for the key are short-circuited
+func (b *Breaker) Allow(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c := b.getCircuit(key)
+	switch c.state {
+	case Open:
+		if elapsed := b.now().Sub(c.openedAt); elapsed < b.coolDown {
+			return &OpenError{Key: key, RetryAfter: b.coolDown - elapsed}
+		}
+		c.probedAt = b.now()
+		b.setState(key, c, HalfOpen)
+		return nil
+	case HalfOpen:
+		// allow another probe if the result of the previous one was never recorded
+		if elapsed := b.now().Sub(c.probedAt); elapsed < b.coolDown {
+			return &OpenError{Key: key, RetryAfter: b.coolDown - elapsed}
+		}
+		c.probedAt = b.now()
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success records a successful call and closes the circuit of the key
+func (b *Breaker) Success(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, exists := b.circuits[key]
+	if !exists {
+		return
+	}
+
+	c.failures = 0
+	b.setState(key, c, Closed)
+}
+
+// Failure records a failed call and opens the circuit of the key if the threshold is reached or the probe failed
+func (b *Breaker) Failure(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c := b.getCircuit(key)
+	c.failures++
+	if c.state == HalfOpen || c.failures >= b.threshold {
+		c.openedAt = b.now()
+		b.setState(key, c, Open)
+	}
+}
+
+// OpenKeys returns the sorted keys of all circuits which are not closed
+func (b *Breaker) OpenKeys() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var keys []string
+	for key, c := range b.circuits {
+		if c.state != Closed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Check is a health check which fails while any circuit is not closed
+func (b *Breaker) Check(_ *http.Request) error {
+	if keys := b.OpenKeys(); len(keys) > 0 {
+		return fmt.Errorf("circuit breaker open for %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// getCircuit returns the circuit of the key and creates a closed one if it doesn't exist yet. The closed state of a new
+// circuit is reported as well, so keys which never failed are reported as healthy.
+func (b *Breaker) getCircuit(key string) *circuit {
+	c, exists := b.circuits[key]
+	if !exists {
+		c = &circuit{state: Closed}
+		b.circuits[key] = c
+		if b.onStateChange != nil {
+			b.onStateChange(key, Closed)
+		}
+	}
+	return c
+}
+
+func (b *Breaker) setState(key string, c *circuit, state State) {
+	if c.state == state {
+		return
+	}
+	c.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(key, state)
+	}
+}
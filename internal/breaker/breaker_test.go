@@ -0,0 +1,169 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const coolDown = time.Minute
+
+// fakeClock is the injectable clock of the breaker
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type transition struct {
+	key   string
+	state State
+}
+
+func newTestBreaker(threshold int) (*Breaker, *fakeClock, *[]transition) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var transitions []transition
+	b := NewBreaker(threshold, coolDown, func(key string, state State) {
+		transitions = append(transitions, transition{key: key, state: state})
+	})
+	b.now = func() time.Time { return clock.now }
+	return b, clock, &transitions
+}
+
+func assertAllowed(t *testing.T, b *Breaker, key string) {
+	t.Helper()
+	if err := b.Allow(key); err != nil {
+		t.Fatalf("expected call for %s to be allowed, got %v", key, err)
+	}
+}
+
+func assertOpen(t *testing.T, b *Breaker, key string, retryAfter time.Duration) {
+	t.Helper()
+	err := b.Allow(key)
+	var openErr *OpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("expected OpenError for %s, got %v", key, err)
+	}
+	if openErr.RetryAfter != retryAfter {
+		t.Errorf("expected retry after %s, got %s", retryAfter, openErr.RetryAfter)
+	}
+}
+
+func assertTransitions(t *testing.T, got []transition, want ...transition) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, got)
+		}
+	}
+}
+
+func TestNewCircuitIsReportedClosed(t *testing.T) {
+	b, _, transitions := newTestBreaker(3)
+
+	assertAllowed(t, b, "docker.io")
+	b.Success("docker.io")
+	assertAllowed(t, b, "docker.io")
+
+	assertTransitions(t, *transitions, transition{"docker.io", Closed})
+	if keys := b.OpenKeys(); len(keys) != 0 {
+		t.Errorf("expected no open keys, got %v", keys)
+	}
+}
+
+func TestOpensAfterConsecutiveFailures(t *testing.T) {
+	b, _, transitions := newTestBreaker(3)
+
+	for i := 0; i < 2; i++ {
+		assertAllowed(t, b, "docker.io")
+		b.Failure("docker.io")
+	}
+	// a success resets the consecutive failures
+	assertAllowed(t, b, "docker.io")
+	b.Success("docker.io")
+
+	for i := 0; i < 3; i++ {
+		assertAllowed(t, b, "docker.io")
+		b.Failure("docker.io")
+	}
+	assertOpen(t, b, "docker.io", coolDown)
+	assertAllowed(t, b, "ghcr.io")
+
+	assertTransitions(t, *transitions,
+		transition{"docker.io", Closed},
+		transition{"docker.io", Open},
+		transition{"ghcr.io", Closed},
+	)
+	if err := b.Check(nil); err == nil {
+		t.Error("expected the health check to fail while a circuit is open")
+	}
+}
+
+func TestSingleProbePerCoolDown(t *testing.T) {
+	b, clock, _ := newTestBreaker(1)
+
+	assertAllowed(t, b, "docker.io")
+	b.Failure("docker.io")
+
+	clock.advance(coolDown - time.Second)
+	assertOpen(t, b, "docker.io", time.Second)
+
+	clock.advance(time.Second)
+	assertAllowed(t, b, "docker.io")
+	// the result of the probe is pending, so no other call is allowed
+	assertOpen(t, b, "docker.io", coolDown)
+
+	clock.advance(coolDown / 2)
+	assertOpen(t, b, "docker.io", coolDown/2)
+
+	// another probe is allowed if the result of the previous one was never recorded
+	clock.advance(coolDown / 2)
+	assertAllowed(t, b, "docker.io")
+}
+
+func TestProbeResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		succeed bool
+		want    []transition
+	}{
+		{
+			name:    "success closes the circuit",
+			succeed: true,
+			want:    []transition{{"docker.io", Closed}, {"docker.io", Open}, {"docker.io", HalfOpen}, {"docker.io", Closed}},
+		},
+		{
+			name:    "failure opens the circuit again",
+			succeed: false,
+			want:    []transition{{"docker.io", Closed}, {"docker.io", Open}, {"docker.io", HalfOpen}, {"docker.io", Open}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, clock, transitions := newTestBreaker(2)
+
+			for i := 0; i < 2; i++ {
+				assertAllowed(t, b, "docker.io")
+				b.Failure("docker.io")
+			}
+			clock.advance(coolDown)
+			assertAllowed(t, b, "docker.io")
+
+			if tt.succeed {
+				b.Success("docker.io")
+				assertAllowed(t, b, "docker.io")
+			} else {
+				b.Failure("docker.io")
+				// a failed probe opens the circuit immediately for another cool-down
+				assertOpen(t, b, "docker.io", coolDown)
+			}
+			assertTransitions(t, *transitions, tt.want...)
+		})
+	}
+}
@@ -5,35 +5,35 @@ import (
 	"time"
 )
 
-type CacheItem struct {
-	Value      time.Time
+type CacheItem[V any] struct {
+	Value      V
 	Expiration int64 // Unix timestamp to determine expiration time
 }
 
-type Cache struct {
-	data  map[string]CacheItem
+type Cache[V any] struct {
+	data  map[string]CacheItem[V]
 	mutex sync.RWMutex
 }
 
 // NewCache Create a new cache
-func NewCache() *Cache {
-	return &Cache{
-		data: make(map[string]CacheItem),
+func NewCache[V any]() *Cache[V] {
+	return &Cache[V]{
+		data: make(map[string]CacheItem[V]),
 	}
 }
 
 // Set a key-value pair with expiration time (in seconds)
-func (c *Cache) Set(key string, value time.Time, duration *time.Duration) {
+func (c *Cache[V]) Set(key string, value V, duration *time.Duration) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.data[key] = CacheItem{
+	c.data[key] = CacheItem[V]{
 		Value:      value,
 		Expiration: time.Now().Add(*duration).Unix(),
 	}
 }
 
 // Get the value by key, returns the value and a bool indicating if it exists and is not expired
-func (c *Cache) Get(key string) (*time.Time, bool) {
+func (c *Cache[V]) Get(key string) (*V, bool) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"slices"
+	"time"
+)
+
+// RolloutHistory is stored in an annotation of the workload and contains the image digests it ran, newest first.
+type RolloutHistory struct {
+	Images []RolloutImage `json:"images"`
+}
+
+// RolloutImage is an image digest of a container of the workload.
+type RolloutImage struct {
+	Container string `json:"container"`
+	Digest    string `json:"digest"`
+	CreatedAt string `json:"createdAt"`
+	// FirstSeen is the creation date of the first annotated pod which ran the digest.
+	FirstSeen string `json:"firstSeen"`
+	// LastSeen is the date the last pod which ran the digest was annotated.
+	LastSeen string `json:"lastSeen"`
+}
+
+// workloadGroupVersions contains the group versions of the workloads whose rollout history is tracked.
+var workloadGroupVersions = map[string]schema.GroupVersion{
+	"Deployment":  {Group: "apps", Version: "v1"},
+	"StatefulSet": {Group: "apps", Version: "v1"},
+	"DaemonSet":   {Group: "apps", Version: "v1"},
+	"ReplicaSet":  {Group: "apps", Version: "v1"},
+	"CronJob":     {Group: "batch", Version: "v1"},
+	"Job":         {Group: "batch", Version: "v1"},
+}
+
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=batch,resources=cronjobs;jobs,verbs=get;list;watch;patch
+
+// getWorkload returns the metadata of the workload or nil if its rollout history isn't tracked or it doesn't exist.
+func getWorkload(ctx context.Context, c client.Reader, namespace string, owner Owner) (*metav1.PartialObjectMetadata, error) {
+	gv, tracked := workloadGroupVersions[owner.Kind]
+	if !tracked {
+		return nil, nil
+	}
+
+	workload := &metav1.PartialObjectMetadata{}
+	workload.SetGroupVersionKind(gv.WithKind(owner.Kind))
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: owner.Name}, workload); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	// readers may clear the type meta, which is required to patch the workload
+	workload.SetGroupVersionKind(gv.WithKind(owner.Kind))
+	return workload, nil
+}
+
+// getRolloutHistory returns the rollout history of the workload, which is empty if it wasn't annotated yet.
+func getRolloutHistory(workload metav1.Object) (*RolloutHistory, error) {
+	history := &RolloutHistory{}
+	value := workload.GetAnnotations()[getAnnotationKey("history")]
+	if value == "" {
+		return history, nil
+	}
+	if err := json.Unmarshal([]byte(value), history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// historyDigest returns the digest of the container in the rollout history, which is the index digest of multi-arch
+// images, so nodes of different platforms don't add a digest per platform
+func historyDigest(container Container) string {
+	if container.IndexDigest != "" {
+		return container.IndexDigest
+	}
+	return container.Digest
+}
+
+// add adds the digest of the container or updates its first and last seen dates and returns whether the digest is new
+// to the history. Only the newest limit images are kept.
+func (h *RolloutHistory) add(container Container, podCreated, now time.Time, limit int) bool {
+	podCreatedAt := podCreated.UTC().Format(time.RFC3339)
+	nowAt := now.UTC().Format(time.RFC3339)
+	digest := historyDigest(container)
+
+	i := slices.IndexFunc(h.Images, func(image RolloutImage) bool {
+		return image.Container == container.Name && image.Digest == digest
+	})
+	added := i < 0
+	if !added {
+		// pods of an older revision may be annotated after the current one, e.g. after a restart of the controller
+		if podCreatedAt < h.Images[i].FirstSeen {
+			h.Images[i].FirstSeen = podCreatedAt
+		}
+		// the last seen date is updated hourly at most to not patch the workload for every pod
+		if lastSeen, err := time.Parse(time.RFC3339, h.Images[i].LastSeen); err != nil || now.Sub(lastSeen) >= time.Hour {
+			h.Images[i].LastSeen = nowAt
+		}
+	} else {
+		h.Images = append(h.Images, RolloutImage{
+			Container: container.Name,
+			Digest:    digest,
+			CreatedAt: container.CreatedAt,
+			FirstSeen: podCreatedAt,
+			LastSeen:  nowAt,
+		})
+	}
+
+	slices.SortStableFunc(h.Images, func(a, b RolloutImage) int {
+		// the dates are formatted as RFC 3339 in UTC, so they can be compared as strings
+		switch {
+		case a.FirstSeen > b.FirstSeen:
+			return -1
+		case a.FirstSeen < b.FirstSeen:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if len(h.Images) > limit {
+		h.Images = h.Images[:limit]
+	}
+	return added
+}
+
+// updateRolloutHistory adds the digests of the containers to the rollout history of the workload and returns the
+// containers whose digest is new to it. The patch fails if the workload was modified in between, so concurrent updates
+// of the history aren't lost.
+func updateRolloutHistory(ctx context.Context, c client.Client, namespace string, owner Owner, podCreated time.Time, containers []Container, limit int) ([]Container, error) {
+	workload, err := getWorkload(ctx, c, namespace, owner)
+	if err != nil || workload == nil {
+		return nil, err
+	}
+
+	history, err := getRolloutHistory(workload)
+	if err != nil {
+		// the invalid history is replaced
+		history = &RolloutHistory{}
+	}
+
+	now := time.Now()
+	var added []Container
+	for _, container := range containers {
+		if historyDigest(container) != "" && history.add(container, podCreated, now, limit) {
+			added = append(added, container)
+		}
+	}
+
+	jsonString, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	if workload.GetAnnotations()[getAnnotationKey("history")] == string(jsonString) {
+		return added, nil
+	}
+
+	base := workload.DeepCopy()
+	annotations := workload.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[getAnnotationKey("history")] = string(jsonString)
+	workload.SetAnnotations(annotations)
+
+	if err := c.Patch(ctx, workload, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// getRolloutStats returns when the workload got a new image digest the last time and how many rollouts it had since
+// the given date. The digests of a rollout are first seen with the same pod, so a rollout which updates several
+// containers counts once.
+func getRolloutStats(history *RolloutHistory, since time.Time) (lastChange time.Time, rollouts int) {
+	revisions := map[time.Time]bool{}
+	for _, image := range history.Images {
+		firstSeen, err := time.Parse(time.RFC3339, image.FirstSeen)
+		if err != nil {
+			continue
+		}
+		if firstSeen.After(lastChange) {
+			lastChange = firstSeen
+		}
+		if firstSeen.After(since) {
+			revisions[firstSeen] = true
+		}
+	}
+	return lastChange, len(revisions)
+}
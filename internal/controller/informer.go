@@ -0,0 +1,62 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// NewCacheOptions returns the options of the manager cache which only watches the pods in scope. The included
+// namespaces restrict all namespaced objects, the excluded namespaces and the pod selector only the pods. The namespace
+// selector is evaluated in the reconciler, as the labels of a namespace may change at any time.
+func NewCacheOptions(opts *Opts) ctrlcache.Options {
+	options := ctrlcache.Options{
+		DefaultTransform: ctrlcache.TransformStripManagedFields(),
+	}
+
+	if opts.IncludeNamespacesFilter != "" {
+		options.DefaultNamespaces = map[string]ctrlcache.Config{}
+		for _, namespace := range strings.Split(opts.IncludeNamespacesFilter, ",") {
+			options.DefaultNamespaces[namespace] = ctrlcache.Config{}
+		}
+	}
+
+	pods := ctrlcache.ByObject{
+		Label:     opts.PodSelector,
+		Transform: stripPod,
+	}
+	if opts.ExcludeNamespacesFilter != "" {
+		var selectors []fields.Selector
+		for _, namespace := range strings.Split(opts.ExcludeNamespacesFilter, ",") {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+		}
+		pods.Field = fields.AndSelectors(selectors...)
+	}
+	options.ByObject = map[client.Object]ctrlcache.ByObject{&corev1.Pod{}: pods}
+
+	return options
+}
+
+// stripPod is the cache transform of pods which only keeps the fields read by the reconciler and the metrics, as the
+// pods dominate the memory of the cache
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+
+	pod.ManagedFields = nil
+	pod.Spec = corev1.PodSpec{
+		NodeName: pod.Spec.NodeName,
+	}
+	pod.Status = corev1.PodStatus{
+		Phase:                      pod.Status.Phase,
+		StartTime:                  pod.Status.StartTime,
+		ContainerStatuses:          pod.Status.ContainerStatuses,
+		InitContainerStatuses:      pod.Status.InitContainerStatuses,
+		EphemeralContainerStatuses: pod.Status.EphemeralContainerStatuses,
+	}
+	return pod, nil
+}
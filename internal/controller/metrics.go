@@ -2,13 +2,21 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/go-logr/logr"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"math"
+	"regexp"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,86 +24,922 @@ const (
 	metricsPrefix = "pod_image_aging"
 )
 
+const (
+	// otherLabelValue is the label value of the series which aggregates the series exceeding the limits
+	otherLabelValue = "other"
+
+	seriesFamilyWorkload   = "workload"
+	seriesFamilyContainer  = "container"
+	seriesFamilyRepository = "repository"
+)
+
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
 // Define Prometheus metrics
 var (
-	oldestImageSeconds = prometheus.NewGaugeVec(
+	clusterImageAgeBuckets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%s_cluster_image_age_days_bucket", metricsPrefix),
+			Help: "The number of images in the cluster whose age is less than or equal to le days",
+		},
+		[]string{"le"},
+	)
+	repositoryOldestImageSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%s_repository_oldest_seconds", metricsPrefix),
+			Help: "The number of seconds since the oldest running image of the repository was created",
+		},
+		[]string{"registry", "repository"},
+	)
+	repositoryYoungestImageSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%s_repository_youngest_seconds", metricsPrefix),
+			Help: "The number of seconds since the youngest running image of the repository was created",
+		},
+		[]string{"registry", "repository"},
+	)
+	repositoryDigestCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%s_repository_digests", metricsPrefix),
+			Help: "The number of distinct image digests of the repository which are running in the cluster",
+		},
+		[]string{"registry", "repository"},
+	)
+	repositoryContainerCount = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_oldest_seconds", metricsPrefix),
-			Help: "The number of seconds since the oldest image in the namespace was created",
+			Name: fmt.Sprintf("%s_repository_containers", metricsPrefix),
+			Help: "The number of containers in the cluster which run an image of the repository",
 		},
-		[]string{"namespace"},
+		[]string{"registry", "repository"},
 	)
-	youngestImageSeconds = prometheus.NewGaugeVec(
+	droppedSeries = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_youngest_seconds", metricsPrefix),
-			Help: "The number of seconds since the youngest image in the namespace was created",
+			Name: fmt.Sprintf("%s_dropped_series", metricsPrefix),
+			Help: "The number of series which currently exceed the series limits and are aggregated into the other series",
+		},
+		[]string{"family"},
+	)
+	droppedSeriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%s_dropped_series_total", metricsPrefix),
+			Help: "The number of series which started to exceed the series limits and were aggregated into the other series",
+		},
+		[]string{"family"},
+	)
+	leadTimeSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: fmt.Sprintf("%s_lead_time_seconds", metricsPrefix),
+			Help: "The time from the image creation until the first pod of the workload using the image digest started",
+			// 1 hour, 6 hours, 1, 3, 7, 14, 30, 90, 180 and 365 days
+			Buckets: []float64{3600, 21600, 86400, 259200, 604800, 1209600, 2592000, 7776000, 15552000, 31536000},
+		},
+		[]string{"namespace", "owner_kind", "owner_name"},
+	)
+	registryInspectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%s_registry_inspections_total", metricsPrefix),
+			Help: "The number of image inspections by registry",
+		},
+		[]string{"registry"},
+	)
+	registryInspectionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("%s_registry_inspection_duration_seconds", metricsPrefix),
+			Help:    "The duration of image inspections by registry",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
 		},
-		[]string{"namespace"},
+		[]string{"registry"},
 	)
-	averageImageSeconds = prometheus.NewGaugeVec(
+	registryCircuitState = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_average_seconds", metricsPrefix),
-			Help: "The average number of seconds since the images in the namespace were created",
+			Name: fmt.Sprintf("%s_registry_circuit_state", metricsPrefix),
+			Help: "The state of the circuit breaker of the registry (0 = closed, 1 = half-open, 2 = open)",
+		},
+		[]string{"registry"},
+	)
+	registryErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%s_registry_errors_total", metricsPrefix),
+			Help: "The number of failed image inspections by registry and error class",
 		},
-		[]string{"namespace"},
+		[]string{"registry", "class"},
 	)
 )
 
 func init() {
-	ctrlmetrics.Registry.MustRegister(oldestImageSeconds, youngestImageSeconds, averageImageSeconds)
+	ctrlmetrics.Registry.MustRegister(clusterImageAgeBuckets, droppedSeries, droppedSeriesTotal, leadTimeSeconds)
+	ctrlmetrics.Registry.MustRegister(repositoryOldestImageSeconds, repositoryYoungestImageSeconds, repositoryDigestCount, repositoryContainerCount)
+	ctrlmetrics.Registry.MustRegister(registryInspectionsTotal, registryInspectionDuration, registryErrorsTotal, registryCircuitState)
+}
+
+// namespaceMetrics contains the metrics of a namespace. They are created by the recorder, because their labels depend on
+// the namespace and pod labels which are copied into the metrics.
+type namespaceMetrics struct {
+	oldestImageSeconds             *prometheus.GaugeVec
+	youngestImageSeconds           *prometheus.GaugeVec
+	averageImageSeconds            *prometheus.GaugeVec
+	quantileImageSeconds           *prometheus.GaugeVec
+	containerCount                 *prometheus.GaugeVec
+	imageAgeBuckets                *prometheus.GaugeVec
+	workloadOldestImageSeconds     *prometheus.GaugeVec
+	workloadAverageImageSeconds    *prometheus.GaugeVec
+	containerImageCreatedTimestamp *prometheus.GaugeVec
+	thresholdExceededContainers    *prometheus.GaugeVec
+	thresholdExceededRatio         *prometheus.GaugeVec
+	workloadSecondsUntilMaxAge     *prometheus.GaugeVec
+	workloadSecondsSinceRollout    *prometheus.GaugeVec
+	workloadRollouts               *prometheus.GaugeVec
+}
+
+func newNamespaceMetrics(namespaceLabels, podLabels []string) *namespaceMetrics {
+	return &namespaceMetrics{
+		oldestImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_oldest_seconds", metricsPrefix),
+				Help: "The number of seconds since the oldest image in the namespace was created",
+			},
+			append([]string{"namespace"}, namespaceLabels...),
+		),
+		youngestImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_youngest_seconds", metricsPrefix),
+				Help: "The number of seconds since the youngest image in the namespace was created",
+			},
+			append([]string{"namespace"}, namespaceLabels...),
+		),
+		averageImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_average_seconds", metricsPrefix),
+				Help: "The average number of seconds since the images in the namespace were created",
+			},
+			append([]string{"namespace"}, namespaceLabels...),
+		),
+		quantileImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_quantile_seconds", metricsPrefix),
+				Help: "The number of seconds since the images in the namespace were created at the given quantile",
+			},
+			append([]string{"namespace", "quantile"}, namespaceLabels...),
+		),
+		containerCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_containers", metricsPrefix),
+				Help: "The number of containers in the namespace which are included in the image age metrics",
+			},
+			append([]string{"namespace"}, namespaceLabels...),
+		),
+		imageAgeBuckets: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_image_age_days_bucket", metricsPrefix),
+				Help: "The number of images in the namespace whose age is less than or equal to le days",
+			},
+			append([]string{"namespace", "le"}, namespaceLabels...),
+		),
+		workloadOldestImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_workload_oldest_seconds", metricsPrefix),
+				Help: "The number of seconds since the oldest image of the workload was created",
+			},
+			append([]string{"namespace", "owner_kind", "owner_name"}, namespaceLabels...),
+		),
+		workloadAverageImageSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_workload_average_seconds", metricsPrefix),
+				Help: "The average number of seconds since the images of the workload were created",
+			},
+			append([]string{"namespace", "owner_kind", "owner_name"}, namespaceLabels...),
+		),
+		containerImageCreatedTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_container_image_created_timestamp_seconds", metricsPrefix),
+				Help: "The Unix time when the image of the container was created",
+			},
+			slices.Concat([]string{"namespace", "pod", "container", "container_type", "image", "digest"}, namespaceLabels, podLabels),
+		),
+		thresholdExceededContainers: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_threshold_exceeded_containers", metricsPrefix),
+				Help: "The number of containers in the namespace whose image is older than the age threshold",
+			},
+			append([]string{"namespace", "threshold"}, namespaceLabels...),
+		),
+		thresholdExceededRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_threshold_exceeded_ratio", metricsPrefix),
+				Help: "The ratio of containers in the namespace whose image is older than the age threshold",
+			},
+			append([]string{"namespace", "threshold"}, namespaceLabels...),
+		),
+		workloadSecondsUntilMaxAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_workload_seconds_until_max_age", metricsPrefix),
+				Help: "The number of seconds until the oldest image of the workload exceeds the maximum image age, negative once exceeded",
+			},
+			append([]string{"namespace", "owner_kind", "owner_name"}, namespaceLabels...),
+		),
+		workloadSecondsSinceRollout: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_workload_seconds_since_image_change", metricsPrefix),
+				Help: "The number of seconds since the workload got a new image digest",
+			},
+			append([]string{"namespace", "owner_kind", "owner_name"}, namespaceLabels...),
+		),
+		workloadRollouts: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%s_workload_rollouts_30d", metricsPrefix),
+				Help: "The number of rollouts with new image digests the workload had in the last 30 days",
+			},
+			append([]string{"namespace", "owner_kind", "owner_name"}, namespaceLabels...),
+		),
+	}
 }
 
-func UpdateMetrics(c client.Client, namespace string, log logr.Logger) error {
-	pods := &corev1.PodList{}
-	err := c.List(context.TODO(), pods, client.InNamespace(namespace))
+func (n *namespaceMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		n.oldestImageSeconds, n.youngestImageSeconds, n.averageImageSeconds, n.quantileImageSeconds,
+		n.containerCount, n.imageAgeBuckets, n.workloadOldestImageSeconds, n.workloadAverageImageSeconds, n.containerImageCreatedTimestamp,
+		n.thresholdExceededContainers, n.thresholdExceededRatio, n.workloadSecondsUntilMaxAge, n.workloadSecondsSinceRollout,
+		n.workloadRollouts,
+	}
+}
+
+// MetricsRecorder maintains the image age metrics from the pods in the informer cache. The metrics of a namespace are
+// recomputed whenever the reconciler observes a pod of it, while UpdateAll acts as a slow consistency sweep.
+type MetricsRecorder struct {
+	client.Reader
+	Opts *Opts
+
+	metrics *namespaceMetrics
+	series  *seriesTracker
+	// namespaceImages contains the images per namespace for the cluster-wide metrics
+	namespaceImages map[string][]imageRecord
+	// namespacesInScope is the number of namespaces in scope of the current update, which share the series limit per
+	// family
+	namespacesInScope int
+	mutex             sync.Mutex
+}
+
+// imageRecord is the image of a container which counts toward the aggregates
+type imageRecord struct {
+	created time.Time
+	// registry and repository are empty if the image name can't be parsed
+	registry   string
+	repository string
+	// digest is the digest of the image index for multi-arch images, so a version counts once for all platforms
+	digest string
+}
+
+// NewMetricsRecorder creates a recorder which reads the pods using the client, which should be backed by the
+// informer cache of the manager, and registers its metrics
+func NewMetricsRecorder(c client.Reader, opts *Opts) (*MetricsRecorder, error) {
+	m := &MetricsRecorder{
+		Reader:          c,
+		Opts:            opts,
+		metrics:         newNamespaceMetrics(getLabelNames("namespace_label_", opts.MetricsNamespaceLabels), getLabelNames("pod_label_", opts.MetricsPodLabels)),
+		series:          newSeriesTracker(),
+		namespaceImages: make(map[string][]imageRecord),
+	}
+
+	for _, collector := range m.metrics.collectors() {
+		if err := ctrlmetrics.Registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// UpdateAll updates the image age metrics of all namespaces and removes the ones of namespaces which no longer exist
+func (m *MetricsRecorder) UpdateAll(ctx context.Context) error {
+	// the lock is held for the whole sweep, so it can't overwrite the series of a concurrent update of a namespace with
+	// pods it listed before
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	namespaces := &corev1.NamespaceList{}
+	if err := m.List(ctx, namespaces); err != nil {
+		return err
+	}
+
+	// the namespaces are counted before any of them is updated, so every namespace gets the same share of the limits
+	namespacesInScope := m.countNamespacesInScope(namespaces.Items)
+	existingNamespaces := map[string]bool{}
+	for _, namespace := range namespaces.Items {
+		existingNamespaces[namespace.Name] = true
+		if err := m.updateNamespace(ctx, namespace.Name, namespacesInScope); err != nil {
+			// keep the series of the previous update
+			log.FromContext(ctx).Error(err, "Failed to update metrics for namespace", "namespace", namespace.Name)
+		}
+	}
+
+	for _, scope := range m.series.scopeNames() {
+		if scope != clusterScope && !existingNamespaces[scope] {
+			m.series.replace(scope, newSeriesSet())
+			delete(m.namespaceImages, scope)
+		}
+	}
+	for _, namespace := range leadTimes.namespaceNames() {
+		if !existingNamespaces[namespace] {
+			leadTimes.prune(namespace, nil)
+		}
+	}
+	m.updateClusterMetrics()
+
+	return nil
+}
+
+// UpdateNamespace recomputes the image age metrics of the pods in scope of the namespace and the cluster-wide metrics
+func (m *MetricsRecorder) UpdateNamespace(ctx context.Context, namespace string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	namespacesInScope := 1
+	if m.Opts.MaxSeriesPerFamily > 0 {
+		namespaces := &corev1.NamespaceList{}
+		if err := m.List(ctx, namespaces, client.UnsafeDisableDeepCopy); err != nil {
+			return err
+		}
+		namespacesInScope = m.countNamespacesInScope(namespaces.Items)
+	}
+	return m.updateNamespace(ctx, namespace, namespacesInScope)
+}
+
+// countNamespacesInScope returns the number of namespaces in scope, which is at least one
+func (m *MetricsRecorder) countNamespacesInScope(namespaces []corev1.Namespace) int {
+	count := 0
+	for _, namespace := range namespaces {
+		if isNamespaceInScope(namespace.Name, namespace.Labels, m.Opts) {
+			count++
+		}
+	}
+	return max(count, 1)
+}
+
+// updateNamespace recomputes the metrics of the namespace with the share of the series limits of the given number of
+// namespaces in scope. The mutex must be held, so the pods are listed and written without a concurrent update in
+// between.
+func (m *MetricsRecorder) updateNamespace(ctx context.Context, namespace string, namespacesInScope int) error {
+	namespaceLabels, err := getNamespaceLabels(ctx, m, namespace, m.Opts)
+	if err != nil {
+		return err
+	}
+
+	// the series of a namespace which left the scope are deleted
+	var pods []corev1.Pod
+	if isNamespaceInScope(namespace, namespaceLabels, m.Opts) {
+		podList := &corev1.PodList{}
+		// the pods are only read, so copying them out of the cache is not required
+		if err := m.List(ctx, podList, client.InNamespace(namespace), client.UnsafeDisableDeepCopy); err != nil {
+			return err
+		}
+		for i := range podList.Items {
+			if isPodInScope(&podList.Items[i], namespaceLabels, m.Opts) {
+				pods = append(pods, podList.Items[i])
+			}
+		}
+	}
+
+	m.namespacesInScope = namespacesInScope
+	series := newSeriesSet()
+	images, workloads, err := m.writeNamespaceMetrics(ctx, series, namespace, getLabelValues(namespaceLabels, m.Opts.MetricsNamespaceLabels), pods)
 	if err != nil {
-		log.Error(err, "Failed to list pods")
 		return err
 	}
 
+	m.series.replace(namespace, series)
+	// the lead times are only kept for the workloads with series of their own, so they share the series limits
+	leadTimes.prune(namespace, workloads)
+	if len(images) == 0 {
+		delete(m.namespaceImages, namespace)
+	} else {
+		m.namespaceImages[namespace] = images
+	}
+	m.updateClusterMetrics()
+
+	return nil
+}
+
+// updateClusterMetrics updates the cluster-wide metrics from the images of all namespaces
+func (m *MetricsRecorder) updateClusterMetrics() {
 	var imageCreationDates []time.Time
-	for _, pod := range pods.Items {
+	repositoryImages := map[[2]string][]imageRecord{}
+	for _, images := range m.namespaceImages {
+		for _, image := range images {
+			imageCreationDates = append(imageCreationDates, image.created)
+
+			// only allowed registries are exported to limit the cardinality of the repository metrics
+			if image.registry != "" && m.Opts.MetricsRegistries.MatchRegistry(image.registry) {
+				key := [2]string{image.registry, image.repository}
+				repositoryImages[key] = append(repositoryImages[key], image)
+			}
+		}
+	}
+
+	now := time.Now()
+	series := newSeriesSet()
+	for i, count := range getImageAgeBucketCounts(imageCreationDates, m.Opts.ImageAgeBuckets, now) {
+		series.set(clusterImageAgeBuckets, float64(count), getBucketLabel(m.Opts.ImageAgeBuckets, i))
+	}
+
+	repositoryImages = limitSeries(series, repositoryImages, [2]string{otherLabelValue, otherLabelValue},
+		m.seriesLimit(clusterScope), seriesFamilyRepository,
+		func(a, b [2]string) int { return slices.Compare(a[:], b[:]) })
+
+	for key, images := range repositoryImages {
+		dates := make([]time.Time, len(images))
+		digests := map[string]bool{}
+		for i, image := range images {
+			dates[i] = image.created
+			if image.digest != "" {
+				digests[image.digest] = true
+			}
+		}
+
+		oldest, youngest, _ := getImageAges(dates, now)
+		series.set(repositoryOldestImageSeconds, oldest, key[0], key[1])
+		series.set(repositoryYoungestImageSeconds, youngest, key[0], key[1])
+		series.set(repositoryDigestCount, float64(len(digests)), key[0], key[1])
+		series.set(repositoryContainerCount, float64(len(images)), key[0], key[1])
+	}
+
+	m.series.replace(clusterScope, series)
+}
+
+// writeNamespaceMetrics writes the image age metrics of the pods of the namespace to the series and returns the images
+// of their containers which count toward the aggregates and the workloads with series of their own
+func (m *MetricsRecorder) writeNamespaceMetrics(ctx context.Context, series *seriesSet, namespace string, namespaceLabelValues []string, pods []corev1.Pod) ([]imageRecord, map[Owner]bool, error) {
+	opts := m.Opts
+	var images []imageRecord
+	var imageCreationDates []time.Time
+	workloadImageCreationDates := map[Owner][]time.Time{}
+	var containers []containerSeries
+	for _, pod := range pods {
 		if !hasStatusAnnotation(&pod) {
 			continue
 		}
 
-		status := &StatusAnnotation{}
-		if err := json.Unmarshal([]byte(pod.Annotations[getAnnotationKey("status")]), status); err != nil {
-			return err
+		status, err := getStatusAnnotation(&pod)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		for _, container := range status.Containers {
-			createdDate, err := time.Parse(time.RFC3339, container.CreatedAt)
-			if err == nil {
+		if isPodRunning(&pod) {
+			containers = append(containers, m.getContainerSeries(&pod, status, namespaceLabelValues)...)
+		}
+
+		for _, kind := range getContainerKinds(&pod, status) {
+			if !slices.Contains(opts.AggregatedContainerTypes, kind.containerType) {
+				continue
+			}
+
+			for _, container := range *kind.annotated {
+				createdDate, err := time.Parse(time.RFC3339, container.CreatedAt)
+				if err != nil {
+					continue
+				}
 				imageCreationDates = append(imageCreationDates, createdDate)
+				// pods annotated by an older version are part of the workload metrics once the reconciler added their
+				// owner, so a workload isn't exported under its intermediate owner as well
+				if status.Owner != nil {
+					workloadImageCreationDates[*status.Owner] = append(workloadImageCreationDates[*status.Owner], createdDate)
+				}
+				images = append(images, newImageRecord(kind, container, createdDate))
 			}
 		}
 	}
 
-	if len(imageCreationDates) > 0 {
-		now := time.Now()
-		oldest := now.Sub(imageCreationDates[0]).Seconds()
-		youngest := oldest
-		var total float64
+	m.writeContainerMetrics(series, namespace, namespaceLabelValues, containers)
 
-		for _, date := range imageCreationDates {
-			seconds := now.Sub(date).Seconds()
-			if seconds > oldest {
-				oldest = seconds
-			}
-			if seconds < youngest {
-				youngest = seconds
+	// namespaces without images don't write any series, so the ones of a previous update are removed
+	if len(imageCreationDates) == 0 {
+		return nil, nil, nil
+	}
+
+	now := time.Now()
+	oldest, youngest, avg := getImageAges(imageCreationDates, now)
+
+	// Update the metrics
+	series.set(m.metrics.oldestImageSeconds, oldest, withLabels(namespaceLabelValues, namespace)...)
+	series.set(m.metrics.youngestImageSeconds, youngest, withLabels(namespaceLabelValues, namespace)...)
+	series.set(m.metrics.averageImageSeconds, avg, withLabels(namespaceLabelValues, namespace)...)
+
+	series.set(m.metrics.containerCount, float64(len(imageCreationDates)), withLabels(namespaceLabelValues, namespace)...)
+
+	for i, value := range getImageAgePercentiles(imageCreationDates, opts.ImageAgePercentiles, now) {
+		series.set(m.metrics.quantileImageSeconds, value, withLabels(namespaceLabelValues, namespace, getQuantileLabel(opts.ImageAgePercentiles[i]))...)
+	}
+
+	for i, count := range getImageAgeBucketCounts(imageCreationDates, opts.ImageAgeBuckets, now) {
+		series.set(m.metrics.imageAgeBuckets, float64(count), withLabels(namespaceLabelValues, namespace, getBucketLabel(opts.ImageAgeBuckets, i))...)
+	}
+
+	for _, threshold := range opts.AgeThresholds {
+		exceeded := countImagesOlderThan(imageCreationDates, threshold.Days, now)
+		series.set(m.metrics.thresholdExceededContainers, float64(exceeded), withLabels(namespaceLabelValues, namespace, threshold.Name)...)
+		series.set(m.metrics.thresholdExceededRatio, float64(exceeded)/float64(len(imageCreationDates)), withLabels(namespaceLabelValues, namespace, threshold.Name)...)
+	}
+
+	workloadImageCreationDates = limitSeries(series, workloadImageCreationDates, Owner{Kind: otherLabelValue, Name: otherLabelValue},
+		m.seriesLimit(namespace), seriesFamilyWorkload,
+		func(a, b Owner) int { return slices.Compare([]string{a.Kind, a.Name}, []string{b.Kind, b.Name}) })
+
+	workloads := map[Owner]bool{}
+	for owner, dates := range workloadImageCreationDates {
+		workloads[owner] = true
+		oldest, _, avg := getImageAges(dates, now)
+		series.set(m.metrics.workloadOldestImageSeconds, oldest, withLabels(namespaceLabelValues, namespace, owner.Kind, owner.Name)...)
+		series.set(m.metrics.workloadAverageImageSeconds, avg, withLabels(namespaceLabelValues, namespace, owner.Kind, owner.Name)...)
+		if opts.MaxImageAge > 0 {
+			series.set(m.metrics.workloadSecondsUntilMaxAge, opts.MaxImageAge.Seconds()-oldest, withLabels(namespaceLabelValues, namespace, owner.Kind, owner.Name)...)
+		}
+		if opts.HistoryLimit > 0 {
+			if err := m.writeRolloutMetrics(ctx, series, namespace, namespaceLabelValues, owner, now); err != nil {
+				return nil, nil, err
 			}
-			total += seconds
 		}
+	}
 
-		avg := total / float64(len(imageCreationDates))
+	return images, workloads, nil
+}
 
-		// Update the metrics
-		oldestImageSeconds.WithLabelValues(namespace).Set(oldest)
-		youngestImageSeconds.WithLabelValues(namespace).Set(youngest)
-		averageImageSeconds.WithLabelValues(namespace).Set(avg)
+// writeRolloutMetrics writes the metrics of the rollout history of the workload to the series
+func (m *MetricsRecorder) writeRolloutMetrics(ctx context.Context, series *seriesSet, namespace string, namespaceLabelValues []string, owner Owner, now time.Time) error {
+	workload, err := getWorkload(ctx, m, namespace, owner)
+	if err != nil || workload == nil {
+		return err
 	}
 
+	history, err := getRolloutHistory(workload)
+	if err != nil {
+		// the invalid history is replaced when the next pod of the workload is annotated
+		return nil
+	}
+
+	lastChange, rollouts := getRolloutStats(history, now.AddDate(0, 0, -30))
+	if lastChange.IsZero() {
+		return nil
+	}
+
+	series.set(m.metrics.workloadSecondsSinceRollout, now.Sub(lastChange).Seconds(), withLabels(namespaceLabelValues, namespace, owner.Kind, owner.Name)...)
+	series.set(m.metrics.workloadRollouts, float64(rollouts), withLabels(namespaceLabelValues, namespace, owner.Kind, owner.Name)...)
 	return nil
 }
+
+// newImageRecord creates the record of an annotated container
+func newImageRecord(kind containerKind, container Container, created time.Time) imageRecord {
+	image, digest := getContainerImage(kind, container)
+	if container.IndexDigest != "" {
+		digest = container.IndexDigest
+	}
+	record := imageRecord{created: created, digest: digest}
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		record.registry = reference.Domain(named)
+		record.repository = reference.Path(named)
+	}
+	return record
+}
+
+// ParseImageAgeBuckets parses a comma-separated list of bucket upper bounds in days
+func ParseImageAgeBuckets(s string) ([]float64, error) {
+	buckets, err := parseIncreasingNumbers(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image age buckets: %w", err)
+	}
+	if len(buckets) > 0 && buckets[0] <= 0 {
+		return nil, fmt.Errorf("invalid image age buckets: expected a positive number of days")
+	}
+	return buckets, nil
+}
+
+// ParseImageAgePercentiles parses a comma-separated list of percentiles between 0 and 100
+func ParseImageAgePercentiles(s string) ([]float64, error) {
+	percentiles, err := parseIncreasingNumbers(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image age percentiles: %w", err)
+	}
+	if len(percentiles) > 0 && (percentiles[0] <= 0 || percentiles[len(percentiles)-1] > 100) {
+		return nil, fmt.Errorf("invalid image age percentiles: expected percentiles between 0 and 100")
+	}
+	return percentiles, nil
+}
+
+// AgeThreshold is a named maximum image age, e.g. of a policy.
+type AgeThreshold struct {
+	Name string
+	Days float64
+}
+
+// ParseAgeThresholds parses a comma-separated list of name=days pairs
+func ParseAgeThresholds(s string) ([]AgeThreshold, error) {
+	var thresholds []AgeThreshold
+	if s == "" {
+		return thresholds, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid age threshold %q, expected name=days", pair)
+		}
+		if slices.ContainsFunc(thresholds, func(t AgeThreshold) bool { return t.Name == name }) {
+			return nil, fmt.Errorf("duplicate age threshold %q", name)
+		}
+
+		days, err := strconv.ParseFloat(value, 64)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid age threshold %q, expected a positive number of days", pair)
+		}
+		thresholds = append(thresholds, AgeThreshold{Name: name, Days: days})
+	}
+
+	return thresholds, nil
+}
+
+// ParseContainerTypes parses a comma-separated list of the container types container, init and ephemeral
+func ParseContainerTypes(s string) ([]string, error) {
+	var containerTypes []string
+	if s == "" {
+		return containerTypes, nil
+	}
+
+	for _, value := range strings.Split(s, ",") {
+		containerType := strings.TrimSpace(value)
+		switch containerType {
+		case containerTypeContainer, containerTypeInit, containerTypeEphemeral:
+			containerTypes = append(containerTypes, containerType)
+		default:
+			return nil, fmt.Errorf("invalid container type %q, expected %s, %s or %s", value, containerTypeContainer,
+				containerTypeInit, containerTypeEphemeral)
+		}
+	}
+
+	return containerTypes, nil
+}
+
+// ParseLabelKeys parses a comma-separated list of the Kubernetes label keys which are copied into the metric labels.
+// Keys whose metric label names collide are rejected, e.g. a.b and a_b.
+func ParseLabelKeys(s string) ([]string, error) {
+	var keys []string
+	if s == "" {
+		return keys, nil
+	}
+
+	metricKeys := map[string]string{}
+	for _, value := range strings.Split(s, ",") {
+		key := strings.TrimSpace(value)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", value, strings.Join(errs, ", "))
+		}
+
+		name := getLabelNames("", []string{key})[0]
+		if other, exists := metricKeys[name]; exists {
+			return nil, fmt.Errorf("label keys %q and %q map to the same metric label name *_label_%s", other, key, name)
+		}
+		metricKeys[name] = key
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// parseIncreasingNumbers parses a comma-separated list of numbers in increasing order
+func parseIncreasingNumbers(s string) ([]float64, error) {
+	var numbers []float64
+	if s == "" {
+		return numbers, nil
+	}
+
+	for _, value := range strings.Split(s, ",") {
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		if len(numbers) > 0 && number <= numbers[len(numbers)-1] {
+			return nil, fmt.Errorf("numbers must be in increasing order")
+		}
+		numbers = append(numbers, number)
+	}
+
+	return numbers, nil
+}
+
+// getImageAgePercentiles returns the image age in seconds of each percentile using the nearest-rank method. The image
+// creation dates must not be empty.
+func getImageAgePercentiles(imageCreationDates []time.Time, percentiles []float64, now time.Time) []float64 {
+	ages := make([]float64, len(imageCreationDates))
+	for i, date := range imageCreationDates {
+		ages[i] = now.Sub(date).Seconds()
+	}
+	sort.Float64s(ages)
+
+	values := make([]float64, len(percentiles))
+	for i, percentile := range percentiles {
+		rank := int(math.Ceil(percentile / 100 * float64(len(ages))))
+		values[i] = ages[max(rank, 1)-1]
+	}
+	return values
+}
+
+// getQuantileLabel returns the quantile label of a percentile, e.g. "0.9" for the 90th percentile
+func getQuantileLabel(percentile float64) string {
+	return strconv.FormatFloat(percentile/100, 'f', -1, 64)
+}
+
+// getImageAgeBucketCounts returns the cumulative number of images whose age in days is less than or equal to the
+// upper bound of each bucket, followed by the total number of images for the +Inf bucket
+func getImageAgeBucketCounts(imageCreationDates []time.Time, buckets []float64, now time.Time) []int {
+	counts := make([]int, len(buckets)+1)
+	for _, date := range imageCreationDates {
+		days := now.Sub(date).Hours() / 24
+		for i, bucket := range buckets {
+			if days <= bucket {
+				counts[i]++
+			}
+		}
+	}
+	counts[len(buckets)] = len(imageCreationDates)
+	return counts
+}
+
+// countImagesOlderThan returns the number of images which are older than the given days
+func countImagesOlderThan(imageCreationDates []time.Time, days float64, now time.Time) int {
+	count := 0
+	for _, date := range imageCreationDates {
+		if now.Sub(date).Hours()/24 > days {
+			count++
+		}
+	}
+	return count
+}
+
+// getBucketLabel returns the le label of the i-th bucket count
+func getBucketLabel(buckets []float64, i int) string {
+	if i == len(buckets) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(buckets[i], 'f', -1, 64)
+}
+
+// getImageAges returns the oldest, youngest and average age in seconds of the image creation dates, which must not
+// be empty.
+func getImageAges(imageCreationDates []time.Time, now time.Time) (oldest, youngest, avg float64) {
+	oldest = now.Sub(imageCreationDates[0]).Seconds()
+	youngest = oldest
+	var total float64
+
+	for _, date := range imageCreationDates {
+		seconds := now.Sub(date).Seconds()
+		if seconds > oldest {
+			oldest = seconds
+		}
+		if seconds < youngest {
+			youngest = seconds
+		}
+		total += seconds
+	}
+
+	return oldest, youngest, total / float64(len(imageCreationDates))
+}
+
+// containerSeries is the image creation timestamp series of a container
+type containerSeries struct {
+	labelValues []string
+	created     time.Time
+}
+
+// getContainerSeries returns the image creation timestamp series of the containers of the pod
+func (m *MetricsRecorder) getContainerSeries(pod *corev1.Pod, status *StatusAnnotation, namespaceLabelValues []string) []containerSeries {
+	var containers []containerSeries
+	podLabelValues := getLabelValues(pod.Labels, m.Opts.MetricsPodLabels)
+	for _, kind := range getContainerKinds(pod, status) {
+		for _, container := range *kind.annotated {
+			createdDate, err := time.Parse(time.RFC3339, container.CreatedAt)
+			if err != nil {
+				continue
+			}
+
+			image, digest := getContainerImage(kind, container)
+			containers = append(containers, containerSeries{
+				labelValues: slices.Concat([]string{pod.Namespace, pod.Name, container.Name, kind.containerType, image, digest},
+					namespaceLabelValues, podLabelValues),
+				created: createdDate,
+			})
+		}
+	}
+	return containers
+}
+
+// writeContainerMetrics writes the image creation timestamps of the containers to the series. The containers
+// exceeding the series limit are aggregated into a single series with the oldest image creation timestamp.
+func (m *MetricsRecorder) writeContainerMetrics(series *seriesSet, namespace string, namespaceLabelValues []string, containers []containerSeries) {
+	key := func(c containerSeries) string { return strings.Join(c.labelValues, "\xff") }
+	containersByKey := map[string][]containerSeries{}
+	for _, container := range containers {
+		containersByKey[key(container)] = append(containersByKey[key(container)], container)
+	}
+
+	otherKey := key(containerSeries{labelValues: slices.Concat(
+		[]string{namespace, otherLabelValue, otherLabelValue, otherLabelValue, otherLabelValue, otherLabelValue},
+		namespaceLabelValues, make([]string, len(m.Opts.MetricsPodLabels)))})
+	containersByKey = limitSeries(series, containersByKey, otherKey, m.seriesLimit(namespace),
+		seriesFamilyContainer, strings.Compare)
+
+	for key, containers := range containersByKey {
+		oldest := containers[0].created
+		for _, container := range containers[1:] {
+			if container.created.Before(oldest) {
+				oldest = container.created
+			}
+		}
+		series.set(m.metrics.containerImageCreatedTimestamp, float64(oldest.Unix()), strings.Split(key, "\xff")...)
+	}
+}
+
+// seriesLimit returns the number of series including the other series a metric may write in the scope or -1 if it's
+// unlimited. Every namespace in scope gets the same share of the limit per family, even if it has no pods, so the sum
+// of the series doesn't depend on the order in which the namespaces are updated. A namespace may always write at least
+// the other series.
+func (m *MetricsRecorder) seriesLimit(scope string) int {
+	limit := -1
+	if m.Opts.MaxSeriesPerNamespace > 0 && scope != clusterScope {
+		limit = m.Opts.MaxSeriesPerNamespace
+	}
+	if m.Opts.MaxSeriesPerFamily > 0 {
+		familyLimit := m.Opts.MaxSeriesPerFamily
+		if scope != clusterScope {
+			familyLimit = max(familyLimit/m.namespacesInScope, 1)
+		}
+		if limit < 0 || familyLimit < limit {
+			limit = familyLimit
+		}
+	}
+	return limit
+}
+
+// limitSeries keeps the first keys in the given order and merges the values of all other keys into the other key, so
+// there are at most limit keys including the other key. The merged keys are added as dropped series of the family to
+// the set.
+func limitSeries[K comparable, V any](series *seriesSet, values map[K][]V, other K, limit int, family string, compare func(a, b K) int) map[K][]V {
+	if limit < 0 || len(values) <= limit {
+		return values
+	}
+
+	keys := make([]K, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	// the keys are sorted to keep the same series across updates
+	slices.SortFunc(keys, compare)
+
+	kept := max(limit-1, 0)
+	limited := make(map[K][]V, limit)
+	for _, key := range keys[:kept] {
+		limited[key] = values[key]
+	}
+	for _, key := range keys[kept:] {
+		limited[other] = append(limited[other], values[key]...)
+	}
+
+	for _, key := range keys[kept:] {
+		series.drop(family, fmt.Sprint(key))
+	}
+	return limited
+}
+
+// getContainerImage returns the image and digest of an annotated container from its status
+func getContainerImage(kind containerKind, container Container) (image, digest string) {
+	digest = container.Digest
+	for _, containerStatus := range kind.statuses {
+		if containerStatus.Name == container.Name {
+			image = containerStatus.Image
+			if digest == "" {
+				digest = getImageDigest(containerStatus.ImageID)
+			}
+		}
+	}
+	return image, digest
+}
+
+// getLabelNames returns the metric label names of the Kubernetes label keys, e.g. pod_label_app_kubernetes_io_name
+// for the pod label app.kubernetes.io/name
+func getLabelNames(prefix string, keys []string) []string {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = prefix + invalidLabelNameChars.ReplaceAllString(key, "_")
+	}
+	return names
+}
+
+// withLabels returns the label values followed by the values of the copied labels
+func withLabels(copiedLabelValues []string, labelValues ...string) []string {
+	return append(labelValues, copiedLabelValues...)
+}
+
+// getLabelValues returns the values of the label keys, which are empty if a label is missing
+func getLabelValues(labels map[string]string, keys []string) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = labels[key]
+	}
+	return values
+}
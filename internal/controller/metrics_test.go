@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+// newTestRecorder creates a recorder whose metrics are not registered, so every test starts with empty metrics
+func newTestRecorder(t *testing.T, opts *Opts, objects ...client.Object) *MetricsRecorder {
+	t.Helper()
+	droppedSeries.Reset()
+	return &MetricsRecorder{
+		Reader:          fake.NewClientBuilder().WithObjects(objects...).Build(),
+		Opts:            opts,
+		metrics:         newNamespaceMetrics(nil, nil),
+		series:          newSeriesTracker(),
+		namespaceImages: make(map[string][]imageRecord),
+	}
+}
+
+// newAnnotatedPod returns a running pod of the deployment whose container is annotated
+func newAnnotatedPod(t *testing.T, namespace, deployment string) *corev1.Pod {
+	t.Helper()
+	status, err := json.Marshal(StatusAnnotation{
+		Owner:      &Owner{Kind: "Deployment", Name: deployment},
+		Containers: []Container{{Name: "app", CreatedAt: "2024-01-01T00:00:00Z", Digest: "sha256:" + deployment}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        deployment,
+			Annotations: map[string]string{getAnnotationKey("status"): string(status)},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestSeriesLimitIsSharedByNamespacesInScope(t *testing.T) {
+	var objects []client.Object
+	for _, namespace := range []string{"a", "b", "c", "d", "excluded"} {
+		objects = append(objects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+		for i := 0; i < 5; i++ {
+			objects = append(objects, newAnnotatedPod(t, namespace, fmt.Sprintf("deployment-%d", i)))
+		}
+	}
+	m := newTestRecorder(t, &Opts{
+		ExcludeNamespacesFilter:  "excluded",
+		AggregatedContainerTypes: []string{containerTypeContainer},
+		MaxSeriesPerFamily:       8,
+	}, objects...)
+
+	// the tracker is empty, like after a restart, so the first namespaces must not get a larger share
+	if err := m.UpdateAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(m.metrics.workloadOldestImageSeconds); got != 8 {
+		t.Errorf("expected 8 workload series, got %d", got)
+	}
+	// every namespace keeps a workload and merges the other 4 workloads into the other series
+	if got := testutil.ToFloat64(droppedSeries.WithLabelValues(seriesFamilyWorkload)); got != 16 {
+		t.Errorf("expected 16 dropped workload series, got %v", got)
+	}
+
+	// a queued update of a single namespace gets the same share
+	if err := m.UpdateNamespace(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(m.metrics.workloadOldestImageSeconds); got != 8 {
+		t.Errorf("expected 8 workload series after the update of a namespace, got %d", got)
+	}
+}
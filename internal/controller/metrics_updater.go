@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"maps"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+// metricsUpdateDelay is the time a namespace waits in the queue, so a burst of pod events updates its metrics only once
+const metricsUpdateDelay = time.Second
+
+// MetricsUpdater is a manager runnable which updates the metrics of the queued namespaces and periodically of all
+// namespaces as a consistency sweep. By default it only runs in the leader, where the pod reconciler queues the
+// namespaces of observed pods.
+type MetricsUpdater struct {
+	recorder *MetricsRecorder
+	cache    ctrlcache.Cache
+	interval time.Duration
+	// allReplicas exports the metrics from every replica instead of the leader only. As the reconciler only runs in
+	// the leader, the namespaces are then queued from the pod events of the informer cache of each replica.
+	allReplicas bool
+	queue       workqueue.TypedDelayingInterface[string]
+}
+
+// NewMetricsUpdater creates the updater, namespaces can be queued before it's started
+func NewMetricsUpdater(recorder *MetricsRecorder, cache ctrlcache.Cache, interval time.Duration, allReplicas bool) *MetricsUpdater {
+	return &MetricsUpdater{
+		recorder:    recorder,
+		cache:       cache,
+		interval:    interval,
+		allReplicas: allReplicas,
+		queue:       workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{Name: "metrics"}),
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (u *MetricsUpdater) NeedLeaderElection() bool {
+	return !u.allReplicas
+}
+
+// Enqueue queues the update of the metrics of the namespace
+func (u *MetricsUpdater) Enqueue(namespace string) {
+	u.queue.AddAfter(namespace, metricsUpdateDelay)
+}
+
+// Start runs the consistency sweep and the updates of the queued namespaces until the context is cancelled
+func (u *MetricsUpdater) Start(ctx context.Context) error {
+	l := ctrl.Log.WithName("metrics")
+	ctx = log.IntoContext(ctx, l)
+
+	go func() {
+		<-ctx.Done()
+		u.queue.ShutDown()
+	}()
+
+	if u.allReplicas {
+		if err := u.watchPods(ctx); err != nil {
+			return err
+		}
+	}
+
+	if !u.cache.WaitForCacheSync(ctx) {
+		return fmt.Errorf("failed to wait for the caches to sync")
+	}
+
+	go u.processQueue(ctx)
+
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		l.Info("Updating metrics...")
+		if err := u.recorder.UpdateAll(ctx); err != nil {
+			l.Error(err, "failed to update metrics")
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			l.Info("Metrics updater stopped")
+			return nil
+		}
+	}
+}
+
+// processQueue updates the metrics of the queued namespaces until the queue is shut down. The queue contains every
+// namespace only once, so the events of a namespace which arrive while it's queued are coalesced.
+func (u *MetricsUpdater) processQueue(ctx context.Context) {
+	for {
+		namespace, shutdown := u.queue.Get()
+		if shutdown {
+			return
+		}
+		if err := u.recorder.UpdateNamespace(ctx, namespace); err != nil && ctx.Err() == nil {
+			log.FromContext(ctx).Error(err, "Failed to update metrics for namespace", "namespace", namespace)
+		}
+		u.queue.Done(namespace)
+	}
+}
+
+// watchPods queues the namespace of every pod event which changes the metrics and of every label change of a
+// namespace
+func (u *MetricsUpdater) watchPods(ctx context.Context) error {
+	informer, err := u.cache.GetInformer(ctx, &corev1.Pod{})
+	if err != nil {
+		return err
+	}
+
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if pod, ok := obj.(client.Object); ok {
+			u.Enqueue(pod.GetNamespace())
+		}
+	}
+
+	if _, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, oldOk := oldObj.(*corev1.Pod)
+			newPod, newOk := newObj.(*corev1.Pod)
+			if !oldOk || !newOk || podMetricsChanged(oldPod, newPod) {
+				enqueue(newObj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}); err != nil {
+		return err
+	}
+
+	// the pods of a namespace may enter or leave the scope of the namespace selector when its labels change
+	if u.recorder.Opts.NamespaceSelector != nil {
+		namespaceInformer, err := u.cache.GetInformer(ctx, &corev1.Namespace{})
+		if err != nil {
+			return err
+		}
+		if _, err := namespaceInformer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNamespace, oldOk := oldObj.(client.Object)
+				newNamespace, newOk := newObj.(client.Object)
+				if oldOk && newOk && !maps.Equal(oldNamespace.GetLabels(), newNamespace.GetLabels()) {
+					u.Enqueue(newNamespace.GetName())
+				}
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// podMetricsChanged returns whether the update of the pod changes its metrics, which only depend on the status
+// annotation, the phase, the labels and whether the pod is terminating
+func podMetricsChanged(oldPod, newPod *corev1.Pod) bool {
+	return oldPod.Annotations[getAnnotationKey("status")] != newPod.Annotations[getAnnotationKey("status")] ||
+		oldPod.Status.Phase != newPod.Status.Phase ||
+		!maps.Equal(oldPod.Labels, newPod.Labels) ||
+		(oldPod.DeletionTimestamp == nil) != (newPod.DeletionTimestamp == nil)
+}
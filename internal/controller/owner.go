@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Owner is the workload which manages a pod.
+type Owner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ownerParents maps the kinds of intermediate owners to the kinds which usually own them.
+var ownerParents = map[string]string{
+	"ReplicaSet": "Deployment",
+	"Job":        "CronJob",
+}
+
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+
+// resolveOwner follows the owner chain of the object up to the top-level workload, e.g. Pod → ReplicaSet → Deployment
+// or Pod → Job → CronJob. Objects without a controller are their own owner.
+func resolveOwner(ctx context.Context, c client.Reader, obj metav1.Object, kind string) (*Owner, error) {
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil {
+		return &Owner{Kind: kind, Name: obj.GetName()}, nil
+	}
+
+	owner := &Owner{Kind: ref.Kind, Name: ref.Name}
+	parentKind, hasParent := ownerParents[ref.Kind]
+	if !hasParent {
+		return owner, nil
+	}
+
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the metadata is fetched to keep the cache of intermediate owners small
+	intermediate := &metav1.PartialObjectMetadata{}
+	intermediate.SetGroupVersionKind(gv.WithKind(ref.Kind))
+	if err := c.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, intermediate); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			return owner, nil
+		}
+		return nil, err
+	}
+
+	parentRef := metav1.GetControllerOf(intermediate)
+	if parentRef == nil || parentRef.Kind != parentKind {
+		return owner, nil
+	}
+
+	return &Owner{Kind: parentRef.Kind, Name: parentRef.Name}, nil
+}
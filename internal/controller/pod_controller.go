@@ -19,18 +19,30 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/go-logr/logr"
+	"github.com/hebestreit/pod-image-aging/internal/breaker"
 	"github.com/hebestreit/pod-image-aging/internal/cache"
+	"github.com/hebestreit/pod-image-aging/internal/imagefilter"
+	"github.com/opencontainers/go-digest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	types2 "k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"slices"
@@ -42,111 +54,221 @@ import (
 type PodReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
-	Cache  *cache.Cache
-	Opts   *Opts
+	Cache  *cache.Cache[ImageInfo]
+	// Breaker short-circuits inspections of unhealthy registries, it's disabled if nil.
+	Breaker *breaker.Breaker
+	// Metrics queues the update of the image age metrics of the namespace of observed pods, it's disabled if nil.
+	Metrics *MetricsUpdater
+	Opts    *Opts
+
+	// seenDigests contains the digests per workload whose lead time was observed if the rollout history is disabled
+	seenDigests *cache.Cache[bool]
+	// indexCreated contains the creation date of the newest platform per image index digest, so the other platforms
+	// of an index aren't fetched again for every platform
+	indexCreated *cache.Cache[time.Time]
 }
 
 type Opts struct {
 	IncludeNamespacesFilter string
 	ExcludeNamespacesFilter string
-	IncludeImagesFilter     string
-	ExcludeImagesFilter     string
-	CacheExpiration         time.Duration
-	DockerAuthConfigPath    string
+	// IncludeImages and ExcludeImages filter the images of containers which are inspected.
+	IncludeImages        *imagefilter.Filter
+	ExcludeImages        *imagefilter.Filter
+	CacheExpiration      time.Duration
+	DockerAuthConfigPath string
+	// RegistryConnectTimeout limits opening an image in its registry, which includes the ping, authentication and
+	// fetching the manifest.
+	RegistryConnectTimeout time.Duration
+	// RegistryReadTimeout limits reading the image configuration of a single platform.
+	RegistryReadTimeout time.Duration
+	// InspectionTimeout is the overall deadline to inspect an image.
+	InspectionTimeout time.Duration
+	// MaxIndexPlatforms is the number of other platforms of an image index which are inspected to get the creation date
+	// of the index, 0 only inspects the platform of the node.
+	MaxIndexPlatforms int
+	// RegistryProxies overrides the proxy of specific registries.
+	RegistryProxies RegistryProxies
+	// ImageAgeBuckets are the upper bounds in days of the image age buckets.
+	ImageAgeBuckets []float64
+	// ImageAgePercentiles are the percentiles of the image age which are exported per namespace.
+	ImageAgePercentiles []float64
+	// AggregatedContainerTypes are the container types which count toward the namespace and workload aggregates.
+	AggregatedContainerTypes []string
+	// MetricsRegistries are the registries whose repositories are exported as metrics.
+	MetricsRegistries *imagefilter.Filter
+	// MetricsNamespaceLabels and MetricsPodLabels are the keys of the namespace and pod labels which are copied into
+	// the metric labels.
+	MetricsNamespaceLabels []string
+	MetricsPodLabels       []string
+	// MaxSeriesPerFamily and MaxSeriesPerNamespace limit the number of series of the workload, container and repository
+	// metrics, 0 disables the limit. Series exceeding the limits are aggregated into an "other" series.
+	MaxSeriesPerFamily    int
+	MaxSeriesPerNamespace int
+	// AgeThresholds are the named image ages for which the exceeding containers are counted per namespace.
+	AgeThresholds []AgeThreshold
+	// MaxImageAge is the maximum image age of the policy which workloads are forecasted to exceed, 0 disables it.
+	MaxImageAge time.Duration
+	// NamespaceSelector and PodSelector restrict the scope in addition to the namespace lists, nil selects everything.
+	NamespaceSelector labels.Selector
+	PodSelector       labels.Selector
+	// HistoryLimit is the number of image digests which are kept in the rollout history of a workload, 0 disables it.
+	HistoryLimit int
 }
 
 type StatusAnnotation struct {
-	Containers     []Container `json:"containers,omitempty"`
-	InitContainers []Container `json:"initContainers,omitempty"`
+	Owner               *Owner      `json:"owner,omitempty"`
+	Containers          []Container `json:"containers,omitempty"`
+	InitContainers      []Container `json:"initContainers,omitempty"`
+	EphemeralContainers []Container `json:"ephemeralContainers,omitempty"`
 }
 
 type Container struct {
 	Name      string `json:"name"`
 	CreatedAt string `json:"createdAt"`
+	// Digest is the digest of the platform manifest the node runs.
+	Digest string `json:"digest,omitempty"`
+	// IndexDigest and IndexCreatedAt are only set for multi-arch images.
+	IndexDigest    string `json:"indexDigest,omitempty"`
+	IndexCreatedAt string `json:"indexCreatedAt,omitempty"`
+	// PlatformLag is set if the platform image was created before the newest platform of the image index.
+	PlatformLag string `json:"platformLag,omitempty"`
+}
+
+// ImageInfo contains the inspection result of a container image.
+type ImageInfo struct {
+	// Digest of the platform manifest.
+	Digest  string
+	Created time.Time
+	// IndexDigest is the digest of the image index, empty if the image is not a multi-arch image.
+	IndexDigest string
+	// IndexCreated is the creation date of the newest platform image referenced by the image index.
+	IndexCreated time.Time
+}
+
+// PlatformLag returns how long the platform image was created before the newest platform of the image index.
+func (i *ImageInfo) PlatformLag() time.Duration {
+	if i.IndexDigest == "" || !i.IndexCreated.After(i.Created) {
+		return 0
+	}
+	return i.IndexCreated.Sub(i.Created)
 }
 
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
-// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;patch
 // +kubebuilder:rbac:groups=core,resources=pods/status,verbs=get
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, span := tracer.Start(ctx, "PodReconciler.Reconcile", trace.WithAttributes(
+		semconv.K8SNamespaceName(req.Namespace),
+		semconv.K8SPodName(req.Name),
+	))
+	result, err := r.reconcile(ctx, req)
+	endSpan(span, err)
+	return result, err
+}
+
+func (r *PodReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
 	pod := &corev1.Pod{}
 	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		if apierrors.IsNotFound(err) {
+			r.updateMetrics(req.Namespace)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
 	}
 
-	if ignorePod(pod) {
-		return ctrl.Result{}, nil
+	status := &StatusAnnotation{}
+	if hasStatusAnnotation(pod) {
+		var err error
+		if status, err = getStatusAnnotation(pod); err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
 	opts := r.Opts
-	includeNamespaces := strings.Split(opts.IncludeNamespacesFilter, ",")
-	excludeNamespaces := strings.Split(opts.ExcludeNamespacesFilter, ",")
-	includeImages := strings.Split(opts.IncludeImagesFilter, ",")
-	excludeImages := strings.Split(opts.ExcludeImagesFilter, ",")
-
-	if (opts.IncludeNamespacesFilter != "" && !slices.Contains(includeNamespaces, pod.Namespace)) || (opts.ExcludeNamespacesFilter != "" && slices.Contains(excludeNamespaces, pod.Namespace)) {
-		return ctrl.Result{}, nil
+	namespaceLabels, err := getNamespaceLabels(ctx, r.Client, pod.Namespace, opts)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
 
-	nodeName := pod.Spec.NodeName
-	if nodeName == "" {
+	// annotated pods are only inspected again if containers were added, e.g. ephemeral debug containers
+	pending := hasPendingContainers(pod, status, opts)
+	// the owner is added to the annotation of pods which were annotated by an older version
+	missingOwner := hasStatusAnnotation(pod) && status.Owner == nil
+	if ignorePod(pod) || (!pending && !missingOwner) || !isPodInScope(pod, namespaceLabels, opts) {
+		if hasStatusAnnotation(pod) {
+			r.updateMetrics(pod.Namespace)
+		}
 		return ctrl.Result{}, nil
 	}
 
 	var node corev1.Node
-	if err := r.Client.Get(ctx, client.ObjectKey{Name: nodeName}, &node); err != nil {
-		return ctrl.Result{}, err
-	}
-
-	var containers []Container
-containerStatuses:
-	for _, container := range pod.Status.ContainerStatuses {
-		if (opts.IncludeImagesFilter != "" && !isImageInWildcardFilter(container.Image, includeImages)) ||
-			(opts.ExcludeImagesFilter != "" && isImageInWildcardFilter(container.Image, excludeImages)) {
-			continue containerStatuses
+	if pending {
+		nodeName := pod.Spec.NodeName
+		if nodeName == "" {
+			return ctrl.Result{}, nil
 		}
-
-		imageCreated, err := getImageCreatedAt(ctx, r.Cache, l, container, node, opts)
-		if err != nil {
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: nodeName}, &node); err != nil {
 			return ctrl.Result{}, err
 		}
-
-		containers = append(containers, Container{
-			Name:      container.Name,
-			CreatedAt: imageCreated.Format(time.RFC3339),
-		})
 	}
 
-	var initContainers []Container
-initContainerStatuses:
-	for _, container := range pod.Status.InitContainerStatuses {
-		if (opts.IncludeImagesFilter != "" && !isImageInWildcardFilter(container.Image, includeImages)) ||
-			(opts.ExcludeImagesFilter != "" && isImageInWildcardFilter(container.Image, excludeImages)) {
-			continue initContainerStatuses
+	var added []Container
+	for _, kind := range getContainerKinds(pod, status) {
+		for _, container := range kind.statuses {
+			if !isContainerPending(container, *kind.annotated, opts) {
+				continue
+			}
+
+			imageInfo, err := getImageInfo(ctx, r.Cache, r.indexCreated, r.Breaker, l, container, node, opts)
+			if err != nil {
+				if ctx.Err() != nil {
+					// the manager is shutting down and cancelled the inspection
+					return ctrl.Result{}, nil
+				}
+				var openErr *breaker.OpenError
+				if errors.As(err, &openErr) {
+					return ctrl.Result{RequeueAfter: openErr.RetryAfter}, nil
+				}
+				return ctrl.Result{}, err
+			}
+
+			*kind.annotated = append(*kind.annotated, newContainer(container.Name, imageInfo))
+			// e.g. ephemeral debug containers are not part of the rollouts of the workload
+			if slices.Contains(opts.AggregatedContainerTypes, kind.containerType) {
+				added = append(added, newContainer(container.Name, imageInfo))
+			}
 		}
+	}
 
-		imageCreated, err := getImageCreatedAt(ctx, r.Cache, l, container, node, opts)
+	if status.Owner == nil {
+		owner, err := resolveOwner(ctx, r.Client, pod, "Pod")
 		if err != nil {
 			return ctrl.Result{}, err
 		}
-
-		initContainers = append(initContainers, Container{
-			Name:      container.Name,
-			CreatedAt: imageCreated.Format(time.RFC3339),
-		})
+		status.Owner = owner
 	}
 
-	if len(containers) == 0 && len(initContainers) == 0 {
-		return ctrl.Result{}, nil
+	// the history is updated first, so it's retried with the annotation of the pod if the update fails
+	if opts.HistoryLimit > 0 && len(added) > 0 {
+		newDigests, err := updateRolloutHistory(ctx, r.Client, pod.Namespace, *status.Owner, pod.CreationTimestamp.Time, added, opts.HistoryLimit)
+		if err != nil {
+			if apierrors.IsConflict(err) {
+				// another pod of the workload updated the history in between
+				return ctrl.Result{Requeue: true}, nil
+			}
+			return ctrl.Result{}, err
+		}
+		// the history is persisted in the workload, so a digest is observed once even across restarts of the controller
+		observeLeadTimes(pod, *status.Owner, newDigests)
 	}
 
-	jsonString, err := json.Marshal(StatusAnnotation{Containers: containers, InitContainers: initContainers})
+	jsonString, err := json.Marshal(status)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -164,21 +286,81 @@ initContainerStatuses:
 		return ctrl.Result{}, err
 	}
 
+	// the update event of the patch triggers the metrics update of the namespace
 	if err := r.Client.Patch(ctx, pod, client.RawPatch(types2.StrategicMergePatchType, patchData)); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	if opts.HistoryLimit == 0 {
+		observeLeadTimes(pod, *status.Owner, r.unseenDigests(pod.Namespace, *status.Owner, added))
+	}
 	return ctrl.Result{}, nil
 }
 
+// unseenDigests returns the containers whose digest wasn't seen in the workload before and remembers them. Without the
+// rollout history the digests are only kept in memory for the cache expiration, so a digest is observed again after a
+// restart of the controller.
+func (r *PodReconciler) unseenDigests(namespace string, owner Owner, containers []Container) []Container {
+	var unseen []Container
+	for _, container := range containers {
+		digest := historyDigest(container)
+		key := strings.Join([]string{namespace, owner.Kind, owner.Name, container.Name, digest}, "/")
+		if _, seen := r.seenDigests.Get(key); seen || digest == "" {
+			continue
+		}
+		r.seenDigests.Set(key, true, &r.Opts.CacheExpiration)
+		unseen = append(unseen, container)
+	}
+	return unseen
+}
+
+// observeLeadTimes records the time from the image creation until the pod started for the containers whose digest is
+// new to the workload
+func observeLeadTimes(pod *corev1.Pod, owner Owner, containers []Container) {
+	startedAt := pod.CreationTimestamp.Time
+	if pod.Status.StartTime != nil {
+		startedAt = pod.Status.StartTime.Time
+	}
+
+	for _, container := range containers {
+		created, err := time.Parse(time.RFC3339, container.CreatedAt)
+		if err != nil {
+			continue
+		}
+		if leadTime := startedAt.Sub(created); leadTime >= 0 {
+			leadTimes.observe(pod.Namespace, owner, leadTime)
+		}
+	}
+}
+
+// updateMetrics queues the update of the image age metrics of the namespace if metrics are enabled. The metrics are
+// updated by the metrics updater, so the reconciler doesn't wait for it.
+func (r *PodReconciler) updateMetrics(namespace string) {
+	if r.Metrics != nil {
+		r.Metrics.Enqueue(namespace)
+	}
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.seenDigests = cache.NewCache[bool]()
+	r.indexCreated = cache.NewCache[time.Time]()
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Pod{}).
+		// the pods of a namespace are reconciled when its labels change, so they are evaluated against the selector again
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(namespacePods(mgr.GetClient())),
+			builder.WithPredicates(namespaceLabelsChanged())).
 		WithEventFilter(predicate.Funcs{
-			CreateFunc:  func(e event.CreateEvent) bool { return false },
-			UpdateFunc:  func(e event.UpdateEvent) bool { return true },
-			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			// create and delete events of annotated pods are required to keep the metrics of their namespace up to date
+			CreateFunc: func(e event.CreateEvent) bool { return true },
+			// other updates like readiness changes neither affect the inspection nor the metrics
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				oldPod, oldOk := e.ObjectOld.(*corev1.Pod)
+				newPod, newOk := e.ObjectNew.(*corev1.Pod)
+				return !oldOk || !newOk || podChanged(oldPod, newPod)
+			},
+			DeleteFunc:  func(e event.DeleteEvent) bool { return true },
 			GenericFunc: func(e event.GenericEvent) bool { return false },
 		}).
 		// TODO check if this can be scaled in a single worker and how horizontally
@@ -188,11 +370,19 @@ func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
-func inspectImage(ctx context.Context, container *corev1.ContainerStatus, os, architecture string, dockerAuthConfigPath string) (*types.ImageInspectInfo, error) {
+func inspectImage(ctx context.Context, container *corev1.ContainerStatus, os, architecture string, indexCreated *cache.Cache[time.Time], b *breaker.Breaker, opts *Opts) (imageInfo *ImageInfo, err error) {
+	ctx, span := tracer.Start(ctx, "inspectImage", trace.WithAttributes(attributeImageID.String(container.ImageID)))
+	defer func() {
+		if imageInfo != nil {
+			span.SetAttributes(attributeDigest.String(imageInfo.Digest))
+		}
+		endSpan(span, err)
+	}()
+
 	sysCtx := &types.SystemContext{
 		ArchitectureChoice:       architecture,
 		OSChoice:                 os,
-		DockerCompatAuthFilePath: dockerAuthConfigPath,
+		DockerCompatAuthFilePath: opts.DockerAuthConfigPath,
 	}
 
 	imageName := container.ImageID
@@ -212,39 +402,222 @@ func inspectImage(ctx context.Context, container *corev1.ContainerStatus, os, ar
 		return nil, fmt.Errorf("error parsing image reference %s: %w", imageName, err)
 	}
 
-	img, err := ref.NewImage(ctx, sysCtx)
+	registry := registryHost(imageName)
+	span.SetAttributes(attributeRegistry.String(registry))
+	if b != nil {
+		if err := b.Allow(registry); err != nil {
+			return nil, newInspectionError(registry, err)
+		}
+	}
+
+	sysCtx.DockerProxyURL = opts.RegistryProxies.proxyURL(registry)
+	registryInspectionsTotal.WithLabelValues(registry).Inc()
+
+	start := time.Now()
+	imageInfo, err = inspectImageSource(ctx, sysCtx, ref, indexCreated, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error creating image %s: %w", imageName, err)
+		inspectionErr := newInspectionError(registry, fmt.Errorf("error inspecting image %s: %w", imageName, err))
+		if inspectionErr.Class != errorClassCanceled {
+			registryInspectionDuration.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+			registryErrorsTotal.WithLabelValues(registry, inspectionErr.Class).Inc()
+		}
+		recordBreakerResult(b, registry, inspectionErr.Class)
+		return nil, inspectionErr
+	}
+	registryInspectionDuration.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+	recordBreakerResult(b, registry, "")
+
+	return imageInfo, nil
+}
+
+// inspectImageSource fetches the manifest of the image reference and inspects the creation date of the platform
+// image and, for multi-arch images, of up to MaxIndexPlatforms other platforms of the image index unless the creation
+// date of the newest platform of the index is cached.
+func inspectImageSource(ctx context.Context, sysCtx *types.SystemContext, ref types.ImageReference, indexCreated *cache.Cache[time.Time], opts *Opts) (*ImageInfo, error) {
+	ctx, cancel := withOptionalTimeout(ctx, opts.InspectionTimeout)
+	defer cancel()
+
+	connectCtx, cancelConnect := withOptionalTimeout(ctx, opts.RegistryConnectTimeout)
+	defer cancelConnect()
+
+	src, err := ref.NewImageSource(connectCtx, sysCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating image source: %w", err)
+	}
+	defer src.Close()
+
+	rawManifest, mimeType, err := src.GetManifest(connectCtx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error computing manifest digest: %w", err)
+	}
+
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		created, err := inspectInstanceCreated(ctx, sysCtx, src, nil, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &ImageInfo{Digest: manifestDigest.String(), Created: created}, nil
+	}
+
+	list, err := manifest.ListFromBlob(rawManifest, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing image index: %w", err)
+	}
+
+	instanceDigest, err := list.ChooseInstance(sysCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error choosing platform: %w", err)
+	}
+
+	created, err := inspectInstanceCreated(ctx, sysCtx, src, &instanceDigest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error inspecting platform %s: %w", instanceDigest, err)
+	}
+	info := &ImageInfo{Digest: instanceDigest.String(), Created: created, IndexDigest: manifestDigest.String(), IndexCreated: created}
+
+	if cachedIndexCreated, found := indexCreated.Get(info.IndexDigest); found {
+		if cachedIndexCreated.After(info.IndexCreated) {
+			info.IndexCreated = *cachedIndexCreated
+		}
+		return info, nil
+	}
+
+	// the age of the index is best effort, so the other platforms only use the remaining time of the inspection and
+	// their errors don't fail it
+	inspected := 0
+	for _, d := range list.Instances() {
+		if d == instanceDigest || !isPlatformInstance(list, d) {
+			continue
+		}
+		if inspected == opts.MaxIndexPlatforms {
+			break
+		}
+		inspected++
+
+		created, err := inspectInstanceCreated(ctx, sysCtx, src, &d, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the other platforms are inspected again with the next pod of the index
+				return info, nil
+			}
+			continue
+		}
+		if created.After(info.IndexCreated) {
+			info.IndexCreated = created
+		}
+	}
+
+	indexCreated.Set(info.IndexDigest, info.IndexCreated, &opts.CacheExpiration)
+	return info, nil
+}
+
+// inspectInstanceCreated returns the creation date of the image instance, or of the image itself if instanceDigest is nil.
+func inspectInstanceCreated(ctx context.Context, sysCtx *types.SystemContext, src types.ImageSource, instanceDigest *digest.Digest, opts *Opts) (time.Time, error) {
+	ctx, cancel := withOptionalTimeout(ctx, opts.RegistryReadTimeout)
+	defer cancel()
+
+	img, err := image.FromUnparsedImage(ctx, sysCtx, image.UnparsedInstance(src, instanceDigest))
+	if err != nil {
+		return time.Time{}, err
 	}
-	defer img.Close()
 
 	imgInspect, err := img.Inspect(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error inspecting image %s: %w", imageName, err)
+		return time.Time{}, err
+	}
+
+	if imgInspect.Created == nil || imgInspect.Created.IsZero() {
+		return time.Time{}, fmt.Errorf("image creation date is zero")
 	}
 
-	return imgInspect, nil
+	return *imgInspect.Created, nil
+}
+
+// isPlatformInstance reports whether the instance of the image index is a runnable image, which excludes
+// attestation manifests that are published with an "unknown" platform.
+func isPlatformInstance(list manifest.List, d digest.Digest) bool {
+	instance, err := list.Instance(d)
+	if err != nil {
+		return false
+	}
+	platform := instance.ReadOnly.Platform
+	return platform == nil || (platform.OS != "unknown" && platform.Architecture != "unknown")
 }
 
-func getImageCreatedAt(ctx context.Context, cache *cache.Cache, l logr.Logger, container corev1.ContainerStatus, node corev1.Node, opts *Opts) (*time.Time, error) {
-	imageCreated, found := cache.Get(container.ImageID)
+func getImageInfo(ctx context.Context, cache *cache.Cache[ImageInfo], indexCreated *cache.Cache[time.Time], b *breaker.Breaker, l logr.Logger, container corev1.ContainerStatus, node corev1.Node, opts *Opts) (*ImageInfo, error) {
+	os, architecture := node.Labels["kubernetes.io/os"], node.Labels["kubernetes.io/arch"]
+	// the image ID of a multi-arch image is the same on all platforms, but the inspection result is platform specific
+	key := strings.Join([]string{container.ImageID, os, architecture}, "|")
+
+	_, span := tracer.Start(ctx, "ImageCache.Get", trace.WithAttributes(attributeImageID.String(container.ImageID)))
+	imageInfo, found := cache.Get(key)
+	span.SetAttributes(attributeCacheHit.Bool(found))
+	if found {
+		span.SetAttributes(attributeDigest.String(imageInfo.Digest))
+	}
+	span.End()
 	if found {
-		l.Info("Using cached image creation date", "Name", container.Name, "ImageID", container.ImageID, "Created", imageCreated)
-		return imageCreated, nil
+		l.Info("Using cached image creation date", "Name", container.Name, "ImageID", container.ImageID, "Created", imageInfo.Created)
+		return imageInfo, nil
 	}
 
 	l.Info("Inspecting image", "Name", container.Name, "ImageID", container.ImageID)
-	imgInspect, err := inspectImage(ctx, &container, node.Labels["kubernetes.io/os"], node.Labels["kubernetes.io/arch"], opts.DockerAuthConfigPath)
+	imageInfo, err := inspectImage(ctx, &container, os, architecture, indexCreated, b, opts)
 	if err != nil {
+		var inspectionErr *InspectionError
+		if errors.As(err, &inspectionErr) {
+			switch inspectionErr.Class {
+			case errorClassCanceled:
+			case errorClassOpen:
+				l.Info("Skipping image inspection of unhealthy registry", "Name", container.Name, "ImageID", container.ImageID,
+					"Registry", inspectionErr.Registry)
+			default:
+				l.Error(err, "Failed to inspect image", "Name", container.Name, "ImageID", container.ImageID,
+					"Registry", inspectionErr.Registry, "ErrorClass", inspectionErr.Class)
+			}
+		}
 		return nil, err
 	}
 
-	if imgInspect.Created.IsZero() {
-		return nil, fmt.Errorf("image creation date is zero")
+	l.Info("Image inspected", "Name", container.Name, "ImageID", container.ImageID, "Created", imageInfo.Created)
+	if lag := imageInfo.PlatformLag(); lag > 0 {
+		l.Info("Platform image lags behind image index", "Name", container.Name, "ImageID", container.ImageID,
+			"Digest", imageInfo.Digest, "IndexDigest", imageInfo.IndexDigest, "Lag", lag)
+	}
+
+	cache.Set(key, *imageInfo, &opts.CacheExpiration)
+	return imageInfo, nil
+}
+
+// withOptionalTimeout returns a context with the given timeout, or the parent context if the timeout is not set.
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// newContainer creates the annotation entry of a container from its image information.
+func newContainer(name string, imageInfo *ImageInfo) Container {
+	container := Container{
+		Name:      name,
+		CreatedAt: imageInfo.Created.Format(time.RFC3339),
+		Digest:    imageInfo.Digest,
 	}
 
-	l.Info("Image inspected", "Name", container.Name, "ImageID", container.ImageID, "Created", imgInspect.Created)
+	if imageInfo.IndexDigest != "" {
+		container.IndexDigest = imageInfo.IndexDigest
+		container.IndexCreatedAt = imageInfo.IndexCreated.Format(time.RFC3339)
+	}
+
+	if lag := imageInfo.PlatformLag(); lag > 0 {
+		container.PlatformLag = lag.String()
+	}
 
-	cache.Set(container.ImageID, *imgInspect.Created, &opts.CacheExpiration)
-	return imgInspect.Created, nil
+	return container
 }
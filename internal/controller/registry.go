@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/hebestreit/pod-image-aging/internal/breaker"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	errorClassAuth      = "auth"
+	errorClassNotFound  = "not_found"
+	errorClassRateLimit = "rate_limit"
+	errorClassTimeout   = "timeout"
+	errorClassTLS       = "tls"
+	errorClassProxy     = "proxy"
+	errorClassCanceled  = "canceled"
+	errorClassOpen      = "circuit_open"
+	errorClassOther     = "other"
+)
+
+const (
+	proxyDirect = "direct"
+)
+
+// RegistryProxies maps registry hosts to the proxy which is used instead of HTTP_PROXY and HTTPS_PROXY. A nil URL
+// routes the registry directly.
+type RegistryProxies map[string]*url.URL
+
+// ParseRegistryProxies parses a comma-separated list of registry=proxy pairs, where proxy is either a proxy URL or
+// "direct".
+func ParseRegistryProxies(s string) (RegistryProxies, error) {
+	proxies := RegistryProxies{}
+	if s == "" {
+		return proxies, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		registry, proxy, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || registry == "" || proxy == "" {
+			return nil, fmt.Errorf("invalid registry proxy %q, expected registry=proxy", pair)
+		}
+
+		if proxy == proxyDirect {
+			proxies[registry] = nil
+			continue
+		}
+
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q for registry %s", proxy, registry)
+		}
+		proxies[registry] = proxyURL
+	}
+
+	return proxies, nil
+}
+
+// RouteDirect adds the registries which are routed directly to NO_PROXY. It must be called before the first HTTP
+// request is made, because the proxy environment variables are only evaluated once. Only the registry host is added,
+// token realms and blob redirects to other hosts still use the proxy of the environment unless they are in NO_PROXY.
+func (p RegistryProxies) RouteDirect() error {
+	var registries []string
+	for registry, proxyURL := range p {
+		if proxyURL == nil {
+			registries = append(registries, registry)
+		}
+	}
+	if len(registries) == 0 {
+		return nil
+	}
+
+	for _, key := range []string{"NO_PROXY", "no_proxy"} {
+		noProxy := append([]string{os.Getenv(key)}, registries...)
+		if noProxy[0] == "" {
+			noProxy = noProxy[1:]
+		}
+		if err := os.Setenv(key, strings.Join(noProxy, ",")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// proxyURL returns the proxy which overrides the environment for the registry or nil if there is none.
+func (p RegistryProxies) proxyURL(registry string) *url.URL {
+	return p[registry]
+}
+
+// InspectionError is returned if an image could not be inspected in its registry.
+type InspectionError struct {
+	Registry string
+	Class    string
+	Err      error
+}
+
+func (e *InspectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InspectionError) Unwrap() error {
+	return e.Err
+}
+
+// newInspectionError wraps err and classifies it to be reported in logs and metrics.
+func newInspectionError(registry string, err error) *InspectionError {
+	return &InspectionError{Registry: registry, Class: classifyRegistryError(err), Err: err}
+}
+
+// isProxyConnectRefused returns whether the proxy refused the CONNECT request, e.g. with 403 for a destination which
+// isn't allowed or 407. The transport returns the status text of the response as plain error in this case, while
+// responses of the registry itself are returned as typed errors.
+func isProxyConnectRefused(err error) bool {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr.Err == nil || errors.Unwrap(urlErr.Err) != nil {
+		return false
+	}
+	for code := http.StatusBadRequest; code <= http.StatusNetworkAuthenticationRequired; code++ {
+		if text := http.StatusText(code); text != "" && urlErr.Err.Error() == text {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyRegistryError returns the error class of an error returned by a registry call.
+func classifyRegistryError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return errorClassCanceled
+	}
+
+	var openErr *breaker.OpenError
+	if errors.As(err, &openErr) {
+		return errorClassOpen
+	}
+
+	var opErr *net.OpError
+	if (errors.As(err, &opErr) && opErr.Op == "proxyconnect") || isProxyConnectRefused(err) {
+		return errorClassProxy
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorClassTimeout
+	}
+
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return errorClassRateLimit
+	}
+
+	var unauthorizedErr docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorizedErr) {
+		return errorClassAuth
+	}
+
+	var registryErr errcode.Error
+	if errors.As(err, &registryErr) {
+		switch registryErr.Code.Descriptor().HTTPStatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return errorClassAuth
+		case http.StatusNotFound:
+			return errorClassNotFound
+		case http.StatusTooManyRequests:
+			return errorClassRateLimit
+		}
+	}
+
+	var (
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		certificateInvalidErr x509.CertificateInvalidError
+		hostnameErr           x509.HostnameError
+		verificationErr       *tls.CertificateVerificationError
+		recordHeaderErr       tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateInvalidErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &verificationErr) || errors.As(err, &recordHeaderErr) {
+		return errorClassTLS
+	}
+
+	return errorClassOther
+}
+
+// NewRegistryBreaker creates a circuit breaker per registry which exports its state as metric.
+func NewRegistryBreaker(threshold int, coolDown time.Duration) *breaker.Breaker {
+	return breaker.NewBreaker(threshold, coolDown, func(registry string, state breaker.State) {
+		registryCircuitState.WithLabelValues(registry).Set(float64(state))
+	})
+}
+
+// recordBreakerResult records the result of an inspection in the circuit breaker of the registry. Errors which are
+// specific to an image like missing permissions or an unknown manifest don't indicate an unhealthy registry.
+func recordBreakerResult(b *breaker.Breaker, registry string, class string) {
+	if b == nil {
+		return
+	}
+
+	switch class {
+	case "", errorClassAuth, errorClassNotFound:
+		b.Success(registry)
+	case errorClassCanceled, errorClassOpen:
+	default:
+		b.Failure(registry)
+	}
+}
+
+// registryHost returns the registry host of the image reference or "unknown" if it can't be parsed.
+func registryHost(imageName string) string {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "unknown"
+	}
+	return reference.Domain(named)
+}
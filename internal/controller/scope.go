@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"maps"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"slices"
+	"strings"
+)
+
+// getNamespaceLabels returns the labels of the namespace if they are required to evaluate the scope or copied into the
+// metrics. A namespace which doesn't exist has no labels.
+func getNamespaceLabels(ctx context.Context, c client.Reader, namespace string, opts *Opts) (map[string]string, error) {
+	if opts.NamespaceSelector == nil && len(opts.MetricsNamespaceLabels) == 0 {
+		return nil, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return ns.Labels, nil
+}
+
+// isNamespaceInScope returns whether the namespace is included, not excluded and matches the namespace selector
+func isNamespaceInScope(namespace string, namespaceLabels map[string]string, opts *Opts) bool {
+	if opts.IncludeNamespacesFilter != "" && !slices.Contains(strings.Split(opts.IncludeNamespacesFilter, ","), namespace) {
+		return false
+	}
+	if opts.ExcludeNamespacesFilter != "" && slices.Contains(strings.Split(opts.ExcludeNamespacesFilter, ","), namespace) {
+		return false
+	}
+	return opts.NamespaceSelector == nil || opts.NamespaceSelector.Matches(labels.Set(namespaceLabels))
+}
+
+// isPodInScope returns whether the namespace of the pod is in scope and the pod matches the pod selector. Pods out of
+// scope are neither inspected nor part of the metrics.
+func isPodInScope(pod *corev1.Pod, namespaceLabels map[string]string, opts *Opts) bool {
+	if !isNamespaceInScope(pod.Namespace, namespaceLabels, opts) {
+		return false
+	}
+	return opts.PodSelector == nil || opts.PodSelector.Matches(labels.Set(pod.Labels))
+}
+
+// namespaceLabelsChanged passes the update events of namespaces whose labels changed, which may move their pods in or
+// out of the scope of the namespace selector
+func namespaceLabelsChanged() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !maps.Equal(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+		},
+		DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return false },
+	}
+}
+
+// namespacePods returns a request for every pod of the namespace
+func namespacePods(c client.Reader) func(ctx context.Context, namespace client.Object) []reconcile.Request {
+	return func(ctx context.Context, namespace client.Object) []reconcile.Request {
+		pods := &corev1.PodList{}
+		if err := c.List(ctx, pods, client.InNamespace(namespace.GetName()), client.UnsafeDisableDeepCopy); err != nil {
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(pods.Items))
+		for _, pod := range pods.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}})
+		}
+		return requests
+	}
+}
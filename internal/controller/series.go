@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterScope is the scope of series which are not specific to a namespace
+const clusterScope = ""
+
+// leadTimeGracePeriod is the time the lead time series of a workload are kept after an observation even if the
+// workload has no series of its own, as the informer cache may not contain its annotated pod yet
+const leadTimeGracePeriod = time.Minute
+
+type seriesKey struct {
+	vec    *prometheus.GaugeVec
+	labels string
+}
+
+type seriesValue struct {
+	labelValues []string
+	value       float64
+}
+
+// seriesSet contains the series of an update of a scope and the keys of the series per family which exceeded the
+// limits. They are staged and only written by replace, so a failed update doesn't leave any series behind.
+type seriesSet struct {
+	series  map[seriesKey]seriesValue
+	dropped map[string]map[string]bool
+}
+
+func newSeriesSet() *seriesSet {
+	return &seriesSet{
+		series:  make(map[seriesKey]seriesValue),
+		dropped: make(map[string]map[string]bool),
+	}
+}
+
+// set adds the series to the set
+func (s *seriesSet) set(vec *prometheus.GaugeVec, value float64, labelValues ...string) {
+	s.series[seriesKey{vec: vec, labels: strings.Join(labelValues, "\xff")}] = seriesValue{labelValues: labelValues, value: value}
+}
+
+// drop adds the key of a series of the family which was aggregated into the other series
+func (s *seriesSet) drop(family, key string) {
+	if s.dropped[family] == nil {
+		s.dropped[family] = make(map[string]bool)
+	}
+	s.dropped[family][key] = true
+}
+
+// seriesTracker remembers the series written per scope, which is a namespace or the cluster, to delete the ones which
+// are not refreshed by the next update of the scope
+type seriesTracker struct {
+	scopes map[string]*seriesSet
+	mutex  sync.Mutex
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		scopes: make(map[string]*seriesSet),
+	}
+}
+
+// replace writes the series of the current set and deletes the series of the scope which were written before but are
+// not part of it. The dropped series are exported as sum of all scopes and the series which weren't dropped by the
+// previous update of the scope are counted.
+func (t *seriesTracker) replace(scope string, current *seriesSet) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	previous, exists := t.scopes[scope]
+	if !exists {
+		previous = newSeriesSet()
+	}
+	for key, series := range previous.series {
+		if _, refreshed := current.series[key]; !refreshed {
+			key.vec.DeleteLabelValues(series.labelValues...)
+		}
+	}
+	for key, series := range current.series {
+		key.vec.WithLabelValues(series.labelValues...).Set(series.value)
+	}
+
+	if len(current.series) == 0 {
+		delete(t.scopes, scope)
+	} else {
+		t.scopes[scope] = current
+	}
+
+	for _, family := range []string{seriesFamilyWorkload, seriesFamilyContainer, seriesFamilyRepository} {
+		newlyDropped := 0
+		for key := range current.dropped[family] {
+			if !previous.dropped[family][key] {
+				newlyDropped++
+			}
+		}
+		droppedSeriesTotal.WithLabelValues(family).Add(float64(newlyDropped))
+
+		dropped := 0
+		for _, set := range t.scopes {
+			dropped += len(set.dropped[family])
+		}
+		droppedSeries.WithLabelValues(family).Set(float64(dropped))
+	}
+}
+
+// scopeNames returns the names of all scopes with series
+func (t *seriesTracker) scopeNames() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	names := make([]string, 0, len(t.scopes))
+	for name := range t.scopes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// leadTimeTracker remembers the workloads with lead time series per namespace and when their last lead time was
+// observed, so the series of workloads which are deleted or exceed the series limits are removed
+type leadTimeTracker struct {
+	namespaces map[string]map[Owner]time.Time
+	mutex      sync.Mutex
+}
+
+var leadTimes = &leadTimeTracker{
+	namespaces: make(map[string]map[Owner]time.Time),
+}
+
+// observe records the lead time of a new image digest of the workload
+func (t *leadTimeTracker) observe(namespace string, owner Owner, leadTime time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.namespaces[namespace] == nil {
+		t.namespaces[namespace] = make(map[Owner]time.Time)
+	}
+	t.namespaces[namespace][owner] = time.Now()
+	leadTimeSeconds.WithLabelValues(namespace, owner.Kind, owner.Name).Observe(leadTime.Seconds())
+}
+
+// prune deletes the lead time series of the workloads of the namespace which are not part of the given workloads,
+// unless they were observed within the grace period
+func (t *leadTimeTracker) prune(namespace string, workloads map[Owner]bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	for owner, observed := range t.namespaces[namespace] {
+		if !workloads[owner] && now.Sub(observed) >= leadTimeGracePeriod {
+			leadTimeSeconds.DeleteLabelValues(namespace, owner.Kind, owner.Name)
+			delete(t.namespaces[namespace], owner)
+		}
+	}
+	if len(t.namespaces[namespace]) == 0 {
+		delete(t.namespaces, namespace)
+	}
+}
+
+// namespaceNames returns the names of all namespaces with lead time series
+func (t *leadTimeTracker) namespaceNames() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	names := make([]string, 0, len(t.namespaces))
+	for name := range t.namespaces {
+		names = append(names, name)
+	}
+	return names
+}
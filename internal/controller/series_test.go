@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestGaugeVec() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test"}, []string{"name"})
+}
+
+func TestLimitSeries(t *testing.T) {
+	values := map[string][]int{"a": {1}, "b": {2}, "c": {3}, "d": {4, 5}}
+
+	tests := []struct {
+		name        string
+		limit       int
+		want        map[string][]int
+		wantDropped []string
+	}{
+		{
+			name:  "unlimited",
+			limit: -1,
+			want:  values,
+		},
+		{
+			name:  "within the limit",
+			limit: 4,
+			want:  values,
+		},
+		{
+			name:        "keeps the first keys and merges the others",
+			limit:       3,
+			want:        map[string][]int{"a": {1}, "b": {2}, otherLabelValue: {3, 4, 5}},
+			wantDropped: []string{"c", "d"},
+		},
+		{
+			name:        "keeps the other key only",
+			limit:       1,
+			want:        map[string][]int{otherLabelValue: {1, 2, 3, 4, 5}},
+			wantDropped: []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := newSeriesSet()
+			got := limitSeries(series, values, otherLabelValue, tt.limit, seriesFamilyWorkload, strings.Compare)
+
+			if !maps.EqualFunc(got, tt.want, slices.Equal[[]int]) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+			dropped := slices.Sorted(maps.Keys(series.dropped[seriesFamilyWorkload]))
+			if !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("expected dropped series %v, got %v", tt.wantDropped, dropped)
+			}
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	droppedSeries.Reset()
+	droppedSeriesTotal.Reset()
+	vec := newTestGaugeVec()
+	tracker := newSeriesTracker()
+
+	updates := []struct {
+		name        string
+		scope       string
+		series      map[string]float64
+		dropped     []string
+		wantSeries  map[string]float64
+		wantDropped float64
+		wantTotal   float64
+		wantScopes  int
+	}{
+		{
+			name:        "writes the series",
+			scope:       "a",
+			series:      map[string]float64{"x": 1, "y": 2},
+			dropped:     []string{"z"},
+			wantSeries:  map[string]float64{"x": 1, "y": 2},
+			wantDropped: 1,
+			wantTotal:   1,
+			wantScopes:  1,
+		},
+		{
+			name:        "deletes the series which are not refreshed",
+			scope:       "a",
+			series:      map[string]float64{"x": 3},
+			dropped:     []string{"z"},
+			wantSeries:  map[string]float64{"x": 3},
+			wantDropped: 1,
+			wantTotal:   1,
+			wantScopes:  1,
+		},
+		{
+			name:        "sums the dropped series of all scopes",
+			scope:       "b",
+			series:      map[string]float64{"w": 4},
+			dropped:     []string{"v", "z"},
+			wantSeries:  map[string]float64{"x": 3, "w": 4},
+			wantDropped: 3,
+			wantTotal:   3,
+			wantScopes:  2,
+		},
+		{
+			name:        "counts the newly dropped series only",
+			scope:       "a",
+			series:      map[string]float64{"x": 5},
+			dropped:     []string{"y", "z"},
+			wantSeries:  map[string]float64{"x": 5, "w": 4},
+			wantDropped: 4,
+			wantTotal:   4,
+			wantScopes:  2,
+		},
+		{
+			name:        "removes scopes without series",
+			scope:       "b",
+			wantSeries:  map[string]float64{"x": 5},
+			wantDropped: 2,
+			wantTotal:   4,
+			wantScopes:  1,
+		},
+	}
+
+	for _, update := range updates {
+		t.Run(update.name, func(t *testing.T) {
+			current := newSeriesSet()
+			for name, value := range update.series {
+				current.set(vec, value, name)
+			}
+			for _, key := range update.dropped {
+				current.drop(seriesFamilyWorkload, key)
+			}
+			tracker.replace(update.scope, current)
+
+			if got := testutil.CollectAndCount(vec); got != len(update.wantSeries) {
+				t.Errorf("expected %d series, got %d", len(update.wantSeries), got)
+			}
+			for name, value := range update.wantSeries {
+				if got := testutil.ToFloat64(vec.WithLabelValues(name)); got != value {
+					t.Errorf("expected %v for %s, got %v", value, name, got)
+				}
+			}
+			if got := testutil.ToFloat64(droppedSeries.WithLabelValues(seriesFamilyWorkload)); got != update.wantDropped {
+				t.Errorf("expected %v dropped series, got %v", update.wantDropped, got)
+			}
+			if got := testutil.ToFloat64(droppedSeriesTotal.WithLabelValues(seriesFamilyWorkload)); got != update.wantTotal {
+				t.Errorf("expected %v dropped series in total, got %v", update.wantTotal, got)
+			}
+			if got := len(tracker.scopeNames()); got != update.wantScopes {
+				t.Errorf("expected %d scopes, got %d", update.wantScopes, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of reconciles and image inspections. It's a no-op unless a tracer provider is registered.
+var tracer = otel.Tracer("github.com/hebestreit/pod-image-aging/internal/controller")
+
+const (
+	attributeImageID    = attribute.Key("image.id")
+	attributeDigest     = attribute.Key("image.digest")
+	attributeRegistry   = attribute.Key("registry.host")
+	attributeCacheHit   = attribute.Key("cache.hit")
+	attributeErrorClass = attribute.Key("error.class")
+)
+
+// endSpan records the error of the span, including its class for inspection errors, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		var inspectionErr *InspectionError
+		if errors.As(err, &inspectionErr) {
+			span.SetAttributes(attributeErrorClass.String(inspectionErr.Class))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
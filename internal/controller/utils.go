@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/hebestreit/pod-image-aging/internal/imagefilter"
 	corev1 "k8s.io/api/core/v1"
-	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -11,11 +13,13 @@ const (
 	domain = "pod-image-aging.hbst.io"
 )
 
-func ignorePod(pod *corev1.Pod) bool {
-	if hasStatusAnnotation(pod) {
-		return true
-	}
+const (
+	containerTypeContainer = "container"
+	containerTypeInit      = "init"
+	containerTypeEphemeral = "ephemeral"
+)
 
+func ignorePod(pod *corev1.Pod) bool {
 	if pod.Annotations[getAnnotationKey("ignore")] == "true" {
 		return true
 	}
@@ -31,40 +35,102 @@ func ignorePod(pod *corev1.Pod) bool {
 	return false
 }
 
+// containerKind groups the container statuses of a kind with their entries in the status annotation.
+type containerKind struct {
+	containerType string
+	statuses      []corev1.ContainerStatus
+	annotated     *[]Container
+}
+
+func getContainerKinds(pod *corev1.Pod, status *StatusAnnotation) []containerKind {
+	return []containerKind{
+		{containerType: containerTypeContainer, statuses: pod.Status.ContainerStatuses, annotated: &status.Containers},
+		{containerType: containerTypeInit, statuses: pod.Status.InitContainerStatuses, annotated: &status.InitContainers},
+		{containerType: containerTypeEphemeral, statuses: pod.Status.EphemeralContainerStatuses, annotated: &status.EphemeralContainers},
+	}
+}
+
+// hasPendingContainers returns true if any container of the pod must be inspected and added to the status annotation.
+func hasPendingContainers(pod *corev1.Pod, status *StatusAnnotation, opts *Opts) bool {
+	for _, kind := range getContainerKinds(pod, status) {
+		for _, container := range kind.statuses {
+			if isContainerPending(container, *kind.annotated, opts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isContainerPending returns true if the image of the container was pulled, isn't filtered and the container isn't
+// annotated yet.
+func isContainerPending(container corev1.ContainerStatus, annotated []Container, opts *Opts) bool {
+	if container.ImageID == "" {
+		return false
+	}
+
+	image := getFilterImage(container)
+	if (!opts.IncludeImages.IsEmpty() && !opts.IncludeImages.Match(image)) || opts.ExcludeImages.Match(image) {
+		return false
+	}
+
+	return !slices.ContainsFunc(annotated, func(c Container) bool { return c.Name == container.Name })
+}
+
+func isPodRunning(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning
+}
+
 func hasStatusAnnotation(pod *corev1.Pod) bool {
 	return pod.Annotations[getAnnotationKey("status")] != ""
 }
-func getAnnotationKey(path string) string {
-	return fmt.Sprintf("%s/%s", domain, path)
+
+func getStatusAnnotation(pod *corev1.Pod) (*StatusAnnotation, error) {
+	status := &StatusAnnotation{}
+	if err := json.Unmarshal([]byte(pod.Annotations[getAnnotationKey("status")]), status); err != nil {
+		return nil, err
+	}
+	return status, nil
 }
 
-// wildCardToRegexp converts a wildcard pattern to a regular expression pattern.
-func wildCardToRegexp(pattern string) string {
-	components := strings.Split(pattern, "*")
-	if len(components) == 1 {
-		// if len is 1, there are no *'s, return exact match pattern
-		return "^" + pattern + "$"
+// getImageDigest returns the digest of the image ID of a container status.
+func getImageDigest(imageID string) string {
+	if _, d, found := strings.Cut(imageID, "@"); found {
+		return d
 	}
-	var result strings.Builder
-	for i, literal := range components {
+	return ""
+}
 
-		// Replace * with .*
-		if i > 0 {
-			result.WriteString(".*")
-		}
+func getAnnotationKey(path string) string {
+	return fmt.Sprintf("%s/%s", domain, path)
+}
 
-		// Quote any regular expression meta characters in the
-		// literal text.
-		result.WriteString(regexp.QuoteMeta(literal))
+// getFilterImage returns the image of the container to match against the image filters. Its digest is taken from the
+// image ID if the image is referenced by tag.
+func getFilterImage(container corev1.ContainerStatus) imagefilter.Image {
+	image := imagefilter.ParseImage(container.Image)
+	if image.Digest == "" {
+		if i := strings.LastIndex(container.ImageID, "@"); i >= 0 {
+			image.Digest = container.ImageID[i+1:]
+		}
 	}
-	return "^" + result.String() + "$"
+	return image
+}
+
+// podChanged returns whether the update of the pod may change its metrics or requires an inspection, e.g. because a
+// container started with a new image
+func podChanged(oldPod, newPod *corev1.Pod) bool {
+	return podMetricsChanged(oldPod, newPod) || oldPod.Spec.NodeName != newPod.Spec.NodeName ||
+		!slices.Equal(getImageIDs(oldPod), getImageIDs(newPod))
 }
 
-func isImageInWildcardFilter(image string, wildcardFilters []string) bool {
-	for _, wildcardFilter := range wildcardFilters {
-		if result, _ := regexp.MatchString(wildCardToRegexp(wildcardFilter), image); result {
-			return true
+// getImageIDs returns the names and image IDs of all containers of the pod
+func getImageIDs(pod *corev1.Pod) []string {
+	var imageIDs []string
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, status := range statuses {
+			imageIDs = append(imageIDs, status.Name+"="+status.ImageID)
 		}
 	}
-	return false
+	return imageIDs
 }
@@ -0,0 +1,254 @@
+package imagefilter
+
+import (
+	"fmt"
+	"github.com/containers/image/v5/docker/reference"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a pattern or field value as regular expression instead of a glob
+const regexPrefix = "regex:"
+
+// Image is an image reference split into the parts which can be matched.
+type Image struct {
+	// Name is the image as written in the pod, e.g. nginx:1.27.
+	Name string
+	// Normalized is the fully qualified reference, e.g. docker.io/library/nginx:1.27.
+	Normalized string
+	Registry   string
+	Repository string
+	// Tag defaults to latest if the reference has neither a tag nor a digest.
+	Tag    string
+	Digest string
+}
+
+// ParseImage splits the image reference into its parts. The parts of references which can't be parsed are empty, so
+// only patterns of the full name match them.
+func ParseImage(name string) Image {
+	image := Image{Name: name}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return image
+	}
+
+	named = reference.TagNameOnly(named)
+	image.Normalized = named.String()
+	image.Registry = reference.Domain(named)
+	image.Repository = reference.Path(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		image.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		image.Digest = digested.Digest().String()
+	}
+	return image
+}
+
+// Filter matches images against a list of patterns, an image matches if any pattern matches.
+type Filter struct {
+	patterns []pattern
+}
+
+// pattern matches an image if all of its set matchers match
+type pattern struct {
+	reference  *regexp.Regexp
+	registry   *regexp.Regexp
+	repository *regexp.Regexp
+	tag        *regexp.Regexp
+	digest     *regexp.Regexp
+}
+
+// Parse compiles a comma-separated list of patterns. A pattern is either
+//   - a glob of the image reference, where * matches any characters except /, ** matches any characters and ? a single
+//     character except /, e.g. ghcr.io/hebestreit/**,
+//   - a regular expression of the image reference prefixed with regex:, e.g. regex:^nginx:1\.2[0-9]$, or
+//   - a semicolon-separated list of field=value matches of the registry, repository, tag and digest, whose values are
+//     globs or regular expressions as well, e.g. registry=*.azurecr.io;tag=regex:^v[0-9]+$.
+//
+// Globs and regular expressions of the image reference match the image as written in the pod or its normalized form.
+func Parse(s string) (*Filter, error) {
+	filter := &Filter{}
+	if s == "" {
+		return filter, nil
+	}
+
+	for _, value := range strings.Split(s, ",") {
+		p, err := parsePattern(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q: %w", value, err)
+		}
+		filter.patterns = append(filter.patterns, p)
+	}
+	return filter, nil
+}
+
+// ParseRegistries compiles a comma-separated list of registry globs or regular expressions, e.g. docker.io,*.azurecr.io.
+func ParseRegistries(s string) (*Filter, error) {
+	filter := &Filter{}
+	if s == "" {
+		return filter, nil
+	}
+
+	for _, value := range strings.Split(s, ",") {
+		registry, err := compile(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry pattern %q: %w", value, err)
+		}
+		filter.patterns = append(filter.patterns, pattern{registry: registry})
+	}
+	return filter, nil
+}
+
+// SingleStarGlobs returns the globs of the image reference in the comma-separated list of patterns with a single *
+// which could match / before ** was introduced, e.g. registry.example.com/* or *nginx*. A * in the tag or digest is
+// ignored, as they never contain /.
+func SingleStarGlobs(s string) []string {
+	var globs []string
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, regexPrefix) || strings.Contains(value, "=") {
+			continue
+		}
+		if hasSingleStar(stripTagAndDigest(value)) {
+			globs = append(globs, value)
+		}
+	}
+	return globs
+}
+
+// stripTagAndDigest removes the tag and digest of the image reference glob, a : before the last / is the port of the
+// registry
+func stripTagAndDigest(glob string) string {
+	if i := strings.Index(glob, "@"); i >= 0 {
+		glob = glob[:i]
+	}
+	if i := strings.LastIndex(glob, ":"); i > strings.LastIndex(glob, "/") {
+		glob = glob[:i]
+	}
+	return glob
+}
+
+// hasSingleStar returns whether the glob contains a * which isn't part of **
+func hasSingleStar(glob string) bool {
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			i++
+		case glob[i] == '*':
+			return true
+		}
+	}
+	return false
+}
+
+func parsePattern(value string) (pattern, error) {
+	if value == "" {
+		return pattern{}, fmt.Errorf("pattern is empty")
+	}
+
+	if strings.HasPrefix(value, regexPrefix) || !strings.Contains(value, "=") {
+		re, err := compile(value)
+		return pattern{reference: re}, err
+	}
+
+	p := pattern{}
+	for _, match := range strings.Split(value, ";") {
+		field, fieldValue, _ := strings.Cut(match, "=")
+		re, err := compile(fieldValue)
+		if err != nil {
+			return pattern{}, fmt.Errorf("field %s: %w", field, err)
+		}
+
+		var target **regexp.Regexp
+		switch field {
+		case "registry":
+			target = &p.registry
+		case "repository":
+			target = &p.repository
+		case "tag":
+			target = &p.tag
+		case "digest":
+			target = &p.digest
+		default:
+			return pattern{}, fmt.Errorf("unknown field %q, expected registry, repository, tag or digest", field)
+		}
+		if *target != nil {
+			return pattern{}, fmt.Errorf("field %s is set more than once", field)
+		}
+		*target = re
+	}
+	return p, nil
+}
+
+// compile compiles a glob or, if it has the regex: prefix, a regular expression
+func compile(value string) (*regexp.Regexp, error) {
+	if expr, found := strings.CutPrefix(value, regexPrefix); found {
+		if expr == "" {
+			return nil, fmt.Errorf("regular expression is empty")
+		}
+		return regexp.Compile(expr)
+	}
+	if value == "" {
+		return nil, fmt.Errorf("glob is empty")
+	}
+	return regexp.Compile(globToRegexp(value))
+}
+
+// globToRegexp converts a glob to an anchored regular expression
+func globToRegexp(glob string) string {
+	var result strings.Builder
+	result.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			result.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			result.WriteString("[^/]*")
+		case glob[i] == '?':
+			result.WriteString("[^/]")
+		default:
+			result.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	result.WriteString("$")
+	return result.String()
+}
+
+// IsEmpty returns whether the filter has no patterns, a nil filter is empty.
+func (f *Filter) IsEmpty() bool {
+	return f == nil || len(f.patterns) == 0
+}
+
+// Match returns whether any pattern matches the image, an empty filter matches no image.
+func (f *Filter) Match(image Image) bool {
+	if f == nil {
+		return false
+	}
+	for _, p := range f.patterns {
+		if p.match(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRegistry returns whether any pattern matches an image of the registry.
+func (f *Filter) MatchRegistry(registry string) bool {
+	return f.Match(Image{Registry: registry})
+}
+
+func (p pattern) match(image Image) bool {
+	if p.reference != nil && !p.reference.MatchString(image.Name) &&
+		(image.Normalized == "" || !p.reference.MatchString(image.Normalized)) {
+		return false
+	}
+	return matchField(p.registry, image.Registry) && matchField(p.repository, image.Repository) &&
+		matchField(p.tag, image.Tag) && matchField(p.digest, image.Digest)
+}
+
+// matchField returns whether the value matches, an unset matcher matches any value
+func matchField(re *regexp.Regexp, value string) bool {
+	return re == nil || re.MatchString(value)
+}
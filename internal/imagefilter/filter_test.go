@@ -0,0 +1,233 @@
+package imagefilter
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		name string
+		want Image
+	}{
+		{
+			name: "nginx",
+			want: Image{Name: "nginx", Normalized: "docker.io/library/nginx:latest", Registry: "docker.io", Repository: "library/nginx", Tag: "latest"},
+		},
+		{
+			name: "ghcr.io/hebestreit/pod-image-aging:v1",
+			want: Image{Name: "ghcr.io/hebestreit/pod-image-aging:v1", Normalized: "ghcr.io/hebestreit/pod-image-aging:v1", Registry: "ghcr.io", Repository: "hebestreit/pod-image-aging", Tag: "v1"},
+		},
+		{
+			name: "localhost:5000/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			want: Image{
+				Name:       "localhost:5000/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+				Normalized: "localhost:5000/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+				Registry:   "localhost:5000",
+				Repository: "app",
+				Digest:     "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+		},
+		{
+			name: "Invalid:Image",
+			want: Image{Name: "Invalid:Image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseImage(tt.name); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGlobs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		image   string
+		want    bool
+	}{
+		{pattern: "ghcr.io/hebestreit/*", image: "ghcr.io/hebestreit/app:v1", want: true},
+		{pattern: "ghcr.io/hebestreit/*", image: "ghcr.io/hebestreit/team/app:v1", want: false},
+		{pattern: "ghcr.io/hebestreit/**", image: "ghcr.io/hebestreit/team/app:v1", want: true},
+		{pattern: "ghcr.io/**/app:v1", image: "ghcr.io/hebestreit/team/app:v1", want: true},
+		{pattern: "nginx:1.2?", image: "nginx:1.27", want: true},
+		{pattern: "nginx:1.2?", image: "nginx:1.2", want: false},
+		{pattern: "nginx:1.2?", image: "nginx:1.270", want: false},
+		{pattern: "ghcr.io/hebestreit?app:*", image: "ghcr.io/hebestreit/app:v1", want: false},
+		// globs are anchored and dots are literal
+		{pattern: "nginx", image: "nginx:1.27", want: false},
+		{pattern: "nginx:1.2*", image: "nginx:1x27", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.image, func(t *testing.T) {
+			filter, err := Parse(tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := filter.Match(ParseImage(tt.image)); got != tt.want {
+				t.Errorf("expected match %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReferenceMatchesNameOrNormalized(t *testing.T) {
+	tests := []struct {
+		pattern string
+		image   string
+		want    bool
+	}{
+		{pattern: "nginx:*", image: "nginx:1.27", want: true},
+		{pattern: "docker.io/library/nginx:*", image: "nginx:1.27", want: true},
+		{pattern: "nginx:*", image: "docker.io/library/nginx:1.27", want: false},
+		{pattern: "docker.io/library/nginx:latest", image: "nginx", want: true},
+		{pattern: "regex:^nginx", image: "docker.io/library/nginx:1.27", want: false},
+		{pattern: "regex:library/nginx", image: "nginx:1.27", want: true},
+		// references which can't be parsed are only matched as written
+		{pattern: "Invalid:*", image: "Invalid:Image", want: true},
+		{pattern: "registry=docker.io", image: "Invalid:Image", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.image, func(t *testing.T) {
+			filter, err := Parse(tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := filter.Match(ParseImage(tt.image)); got != tt.want {
+				t.Errorf("expected match %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		pattern string
+		image   string
+		want    bool
+	}{
+		{pattern: "registry=*.azurecr.io", image: "team.azurecr.io/app:v1", want: true},
+		{pattern: "registry=*.azurecr.io", image: "nginx:1.27", want: false},
+		{pattern: "registry=docker.io;repository=library/*", image: "nginx:1.27", want: true},
+		{pattern: "registry=docker.io;repository=library/*", image: "bitnami/nginx:1.27", want: false},
+		{pattern: "tag=regex:^v[0-9]+$", image: "ghcr.io/hebestreit/app:v12", want: true},
+		{pattern: "tag=regex:^v[0-9]+$", image: "ghcr.io/hebestreit/app:v1.2", want: false},
+		{pattern: "tag=latest", image: "nginx", want: true},
+		{pattern: "digest=sha256:01*", image: "nginx@" + digest, want: true},
+		{pattern: "digest=sha256:01*", image: "nginx:1.27", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.image, func(t *testing.T) {
+			filter, err := Parse(tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := filter.Match(ParseImage(tt.image)); got != tt.want {
+				t.Errorf("expected match %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"nginx,",
+		"regex:",
+		"regex:(",
+		"registry=",
+		"registry=docker.io;registry=ghcr.io",
+		"name=nginx",
+		"tag=regex:[",
+	}
+
+	for _, pattern := range tests {
+		t.Run(pattern, func(t *testing.T) {
+			if _, err := Parse(pattern); err == nil {
+				t.Errorf("expected an error for %q", pattern)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter, err := Parse(" nginx:* , registry=ghcr.io ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !filter.Match(ParseImage("nginx:1.27")) || !filter.Match(ParseImage("ghcr.io/hebestreit/app:v1")) {
+		t.Error("expected any pattern to match")
+	}
+	if filter.Match(ParseImage("quay.io/app:v1")) {
+		t.Error("expected no pattern to match")
+	}
+
+	empty, err := Parse("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var unset *Filter
+	for _, f := range []*Filter{empty, unset} {
+		if !f.IsEmpty() || f.Match(ParseImage("nginx")) {
+			t.Error("expected an empty filter to match no image")
+		}
+	}
+}
+
+func TestParseRegistries(t *testing.T) {
+	filter, err := ParseRegistries("docker.io,*.azurecr.io,regex:^ghcr\\.io$")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for registry, want := range map[string]bool{
+		"docker.io":       true,
+		"team.azurecr.io": true,
+		"ghcr.io":         true,
+		"quay.io":         false,
+		"azurecr.io":      false,
+	} {
+		if got := filter.MatchRegistry(registry); got != want {
+			t.Errorf("expected match %t for %s, got %t", want, registry, got)
+		}
+	}
+}
+
+func TestSingleStarGlobs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{pattern: "registry.example.com/*", want: true},
+		{pattern: "registry.example.com/*/app:*", want: true},
+		{pattern: "*nginx*", want: true},
+		{pattern: "nginx*:1.27", want: true},
+		{pattern: "registry.example.com:5000/*", want: true},
+		{pattern: "ghcr.io/**", want: false},
+		{pattern: "ghcr.io/**/app:v1", want: false},
+		{pattern: "nginx:*", want: false},
+		{pattern: "registry.example.com:5000/app:1.*", want: false},
+		{pattern: "ghcr.io/app@sha256:*", want: false},
+		{pattern: "nginx:1.2?", want: false},
+		{pattern: "regex:^quay.io/*", want: false},
+		{pattern: "repository=team/*", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if got := len(SingleStarGlobs(tt.pattern)) == 1; got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+
+	got := SingleStarGlobs("registry.example.com/*, ghcr.io/**,nginx:*,*nginx*")
+	if want := []string{"registry.example.com/*", "*nginx*"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
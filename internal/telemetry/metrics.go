@@ -0,0 +1,125 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	otelprometheus "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+
+	serviceName = "pod-image-aging"
+	// shutdownTimeout limits the final export when the manager stops
+	shutdownTimeout = 10 * time.Second
+)
+
+// Opts configures the export via OTLP.
+type Opts struct {
+	// Endpoint is the host and port of the OTLP receiver, e.g. otel-collector:4317.
+	Endpoint string
+	// Protocol is either grpc or http.
+	Protocol string
+	// Insecure disables TLS.
+	Insecure bool
+	// ClusterName is added as k8s.cluster.name resource attribute if set.
+	ClusterName string
+}
+
+// Validate returns an error if the protocol is unknown.
+func (o *Opts) Validate() error {
+	if o.Protocol != ProtocolGRPC && o.Protocol != ProtocolHTTP {
+		return fmt.Errorf("invalid OTLP protocol %q, expected %s or %s", o.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	return nil
+}
+
+// MetricsExporter is a manager runnable which periodically exports the metrics of the gatherer whose names start with
+// the prefix via OTLP.
+type MetricsExporter struct {
+	Opts     *Opts
+	Gatherer prometheus.Gatherer
+	Prefix   string
+	Interval time.Duration
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica exports its own metrics
+func (e *MetricsExporter) NeedLeaderElection() bool {
+	return false
+}
+
+// Start exports the metrics until the context is cancelled
+func (e *MetricsExporter) Start(ctx context.Context) error {
+	exporter, err := e.newExporter(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := newResource(e.Opts)
+	if err != nil {
+		return err
+	}
+
+	producer := otelprometheus.NewMetricProducer(otelprometheus.WithGatherer(prefixGatherer(e.Gatherer, e.Prefix)))
+	reader := sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(e.Interval), sdkmetric.WithProducer(producer))
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+
+	log.FromContext(ctx).Info("Exporting metrics via OTLP", "Endpoint", e.Opts.Endpoint, "Protocol", e.Opts.Protocol)
+	<-ctx.Done()
+
+	// the manager context is cancelled, so a new one is required to export the metrics one last time
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return provider.Shutdown(shutdownCtx)
+}
+
+func (e *MetricsExporter) newExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	if e.Opts.Protocol == ProtocolHTTP {
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(e.Opts.Endpoint)}
+		if e.Opts.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(e.Opts.Endpoint)}
+	if e.Opts.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// newResource returns the resource which identifies the controller and its cluster
+func newResource(opts *Opts) (*resource.Resource, error) {
+	attributes := []attribute.KeyValue{semconv.ServiceName(serviceName)}
+	if opts.ClusterName != "" {
+		attributes = append(attributes, semconv.K8SClusterName(opts.ClusterName))
+	}
+	return resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, attributes...))
+}
+
+// prefixGatherer returns a gatherer which only returns the metric families whose names start with the prefix
+func prefixGatherer(g prometheus.Gatherer, prefix string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		filtered := make([]*dto.MetricFamily, 0, len(families))
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), prefix) {
+				filtered = append(filtered, family)
+			}
+		}
+		return filtered, err
+	})
+}
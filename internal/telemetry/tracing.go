@@ -0,0 +1,61 @@
+package telemetry
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// TraceExporter is a manager runnable which registers the global tracer provider and exports its spans via OTLP.
+// Tracers obtained from the global provider before it's registered forward their spans once it is.
+type TraceExporter struct {
+	Opts *Opts
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica exports its own spans
+func (e *TraceExporter) NeedLeaderElection() bool {
+	return false
+}
+
+// Start exports the spans until the context is cancelled
+func (e *TraceExporter) Start(ctx context.Context) error {
+	exporter, err := e.newExporter(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := newResource(e.Opts)
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	log.FromContext(ctx).Info("Exporting traces via OTLP", "Endpoint", e.Opts.Endpoint, "Protocol", e.Opts.Protocol)
+	<-ctx.Done()
+
+	// the manager context is cancelled, so a new one is required to export the remaining spans
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return provider.Shutdown(shutdownCtx)
+}
+
+func (e *TraceExporter) newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	if e.Opts.Protocol == ProtocolHTTP {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(e.Opts.Endpoint)}
+		if e.Opts.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(e.Opts.Endpoint)}
+	if e.Opts.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}